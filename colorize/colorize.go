@@ -1,5 +1,13 @@
 package colorize
 
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
 const (
 	esc   = "\u001B["
 	bold  = esc + "1m"
@@ -7,6 +15,41 @@ const (
 	reset = esc + "m"
 )
 
+// Whether Display keeps colors.
+var enabled = auto()
+
+// Colors are displayed on a terminal, unless NO_COLOR is set.
+func auto() bool {
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !noColor && isatty.IsTerminal(os.Stdout.Fd())
+}
+
+// SetMode sets when colors are displayed: "always", "never" or "auto".
+func SetMode(mode string) error {
+	switch mode {
+	case "always":
+		enabled = true
+	case "never":
+		enabled = false
+	case "auto":
+		enabled = auto()
+	default:
+		return fmt.Errorf("invalid color mode '%s': must be one of `always`, `never` or `auto`", mode)
+	}
+	return nil
+}
+
+// Display returns s as it should be displayed, without colors if they are disabled.
+//
+// Bold and Warn always color their text, so that warnings can be detected with HasWarning.
+// Colored text must pass through Display before it is displayed.
+func Display(s string) string {
+	if enabled {
+		return s
+	}
+	return Strip(s)
+}
+
 func Bold(s string) string {
 	return bold + s + reset
 }
@@ -14,3 +57,13 @@ func Bold(s string) string {
 func Warn(s string) string {
 	return warn + s + reset
 }
+
+// Check if s contains text colored by Warn.
+func HasWarning(s string) bool {
+	return strings.Contains(s, warn)
+}
+
+// Remove the colors added by this package from s.
+func Strip(s string) string {
+	return strings.NewReplacer(warn, "", bold, "", reset, "").Replace(s)
+}
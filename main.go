@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"go/build"
+	"net/mail"
 	"os"
 	"os/exec"
 	"strings"
@@ -19,6 +20,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/pulumi/upgrade-provider/colorize"
+	"github.com/pulumi/upgrade-provider/step"
 	"github.com/pulumi/upgrade-provider/upgrade"
 )
 
@@ -32,6 +34,10 @@ const (
 
 func cmd() *cobra.Command {
 	var targetVersion string
+	var versionConstraint string
+	var gitCommitter string
+	var bridgeVersionConstraint string
+	var compatMatrix string
 	gopath, ok := os.LookupEnv("GOPATH")
 	if !ok {
 		gopath = build.Default.GOPATH
@@ -41,6 +47,21 @@ func cmd() *cobra.Command {
 	var repoName string
 	var repoOrg string
 	var repoPath string
+	var additionalUpstreams []string
+	var timeout time.Duration
+	var skip []string
+	var reportOnly bool
+	var printUpstreamURLs bool
+	var emitGoModJSON bool
+	var envFile string
+	var envVars []string
+	var githubAnnotations bool
+	var color string
+	var target string
+	var tracePath string
+	var stepLogsDir string
+	var providersFile string
+	reporter := step.NewTextReporter()
 
 	context := upgrade.Context{
 		Context: context.Background(),
@@ -58,43 +79,138 @@ func cmd() *cobra.Command {
 	}
 
 	cmd := &cobra.Command{
-		Use:   "upgrade-provider <provider>",
+		Use:   "upgrade-provider [provider]",
 		Short: "upgrade-provider automates the process of upgrading a TF-bridged provider",
-		Args:  cobra.ExactArgs(1),
+		Long: `upgrade-provider automates the process of upgrading a TF-bridged provider.
+
+[provider] is {org}/{repo}, or just {repo} for providers in the --pulumi-org org. If
+[provider] is omitted, it is inferred from provider/go.mod of the provider checked out at
+--repo-path, or at the current directory.`,
+		Args: cobra.RangeArgs(0, 1),
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// The env file is loaded first, so it can set UPGRADE_* variables.
+			if envFile != "" {
+				if err := loadEnvFile(envFile); err != nil {
+					return fmt.Errorf("--env-file=%s: %w", envFile, err)
+				}
+			}
+			for _, kv := range envVars {
+				key, value, found := strings.Cut(kv, "=")
+				if !found || key == "" {
+					return fmt.Errorf("--env=%s: expected KEY=VALUE", kv)
+				}
+				if err := os.Setenv(key, value); err != nil {
+					return fmt.Errorf("--env=%s: %w", key, err)
+				}
+				step.AddSecretEnv(key, value)
+			}
 			err := initializeConfig(cmd)
 			if err != nil {
 				return err
 			}
-			// Validate argument is {org}/{repo}
-			tok := strings.Split(args[0], "/")
-			if len(tok) != 2 {
-				return errors.New("argument must be provided as {org}/{repo}")
+			if err := colorize.SetMode(color); err != nil {
+				return fmt.Errorf("--color=%s: %w", color, err)
 			}
-			repoOrg, repoName = tok[0], tok[1]
-			// repo name should start with 'pulumi-'
-			if !strings.HasPrefix(repoName, "pulumi-") {
-				return errors.New("{repo} must start with `pulumi-`")
+			if providersFile != "" {
+				if len(args) > 0 {
+					return errors.New("[provider] and --providers-file are mutually exclusive")
+				}
+				if repoPath != "" {
+					return errors.New("--repo-path and --providers-file are mutually exclusive")
+				}
+				if context.UpstreamOwnerRepo != "" {
+					return errors.New("--upstream-owner-repo and --providers-file are mutually exclusive")
+				}
+				if context.ProviderRepoURL != "" {
+					return errors.New("--provider-repo-url and --providers-file are mutually exclusive")
+				}
+			} else if len(args) == 0 {
+				dir := repoPath
+				if dir == "" {
+					dir = "."
+				}
+				repoOrg, repoName, err = upgrade.InferProviderRepo(dir)
+				if err != nil {
+					return fmt.Errorf("could not infer {org}/{repo}, please pass it: %w", err)
+				}
+			} else if !strings.Contains(args[0], "/") {
+				repoOrg, repoName = context.PulumiOrg, args[0]
+			} else {
+				// Validate argument is {org}/{repo}
+				tok := strings.Split(args[0], "/")
+				if len(tok) != 2 {
+					return errors.New("argument must be provided as {org}/{repo}")
+				}
+				repoOrg, repoName = tok[0], tok[1]
 			}
-			// Require `upstream-provider-name` to be set
-			if context.UpstreamProviderName == "" {
-				return errors.New("`upstream-provider-name` must be provided")
+			if providersFile == "" {
+				// repo name should start with 'pulumi-'
+				if !strings.HasPrefix(repoName, "pulumi-") {
+					return errors.New("{repo} must start with `pulumi-`")
+				}
+				// Require `upstream-provider-name` to be set
+				if context.UpstreamProviderName == "" {
+					return errors.New("`upstream-provider-name` must be provided")
+				}
+			}
+
+			if context.UpstreamOwnerRepo != "" {
+				owner, repo, _ := strings.Cut(context.UpstreamOwnerRepo, "/")
+				if owner == "" || repo == "" || strings.Contains(repo, "/") {
+					return fmt.Errorf("--upstream-owner-repo=%s: must be provided as {owner}/{repo}",
+						context.UpstreamOwnerRepo)
+				}
 			}
 
 			// Validate that targetVersion is a valid version
 			if targetVersion != "" {
-				context.TargetVersion, err = semver.NewVersion(targetVersion)
+				context.TargetVersion, err = context.ParseVersion(targetVersion)
 				if err != nil {
 					return fmt.Errorf("--target-version=%s: %w",
 						targetVersion, err)
 				}
 			}
 
+			if versionConstraint != "" {
+				context.VersionConstraint, err = semver.NewConstraint(versionConstraint)
+				if err != nil {
+					return fmt.Errorf("--version-constraint=%s: %w", versionConstraint, err)
+				}
+			}
+
+			if bridgeVersionConstraint != "" {
+				context.BridgeVersionConstraint, err = semver.NewConstraint(bridgeVersionConstraint)
+				if err != nil {
+					return fmt.Errorf("--bridge-version-constraint=%s: %w", bridgeVersionConstraint, err)
+				}
+			}
+
+			context.CompatMatrix, err = upgrade.ReadCompatMatrix(compatMatrix)
+			if err != nil {
+				return fmt.Errorf("--compat-matrix: %w", err)
+			}
+
+			// Validate that each additional upstream is {name}={version}
+			for _, upstream := range additionalUpstreams {
+				name, version, found := strings.Cut(upstream, "=")
+				if !found || name == "" {
+					return fmt.Errorf("--upstream=%s: must be provided as {name}={version}", upstream)
+				}
+				v, err := context.ParseVersion(version)
+				if err != nil {
+					return fmt.Errorf("--upstream=%s: %w", upstream, err)
+				}
+				if context.AdditionalUpstreams == nil {
+					context.AdditionalUpstreams = map[string]*semver.Version{}
+				}
+				context.AdditionalUpstreams[name] = v
+			}
+
 			// Validate the kind switch
 			var warnedAll bool
 			for _, kind := range upgradeKind {
 				warn := func(msg string, a ...any) {
-					fmt.Println(colorize.Warn(fmt.Sprintf(msg, a...)))
+					fmt.Println(colorize.Display(colorize.Warn(fmt.Sprintf(msg, a...))))
 				}
 				set := func(v *bool) {
 					if *v && !warnedAll {
@@ -136,17 +252,184 @@ func cmd() *cobra.Command {
 						upgradeKind)
 				}
 			}
+			switch context.IssueState {
+			case "open", "closed", "all":
+			default:
+				return fmt.Errorf("--issue-state=%s invalid. Must be one of `open`, `closed` or `all`.",
+					context.IssueState)
+			}
+			switch context.CommitStyle {
+			case "plain", "conventional":
+			default:
+				return fmt.Errorf("--commit-style=%s invalid. Must be one of `plain` or `conventional`.",
+					context.CommitStyle)
+			}
+
+			switch context.CommitMode {
+			case "two", "squash", "per-step":
+			default:
+				return fmt.Errorf("--commit-mode=%s invalid. Must be one of `two`, `squash` or `per-step`.",
+					context.CommitMode)
+			}
+
+			switch context.ReportFormat {
+			case "text", "json", "markdown":
+			default:
+				return fmt.Errorf("--report-format=%s invalid. Must be one of `text`, `json` or `markdown`.",
+					context.ReportFormat)
+			}
+
+			if gitCommitter != "" {
+				committer, err := mail.ParseAddress(gitCommitter)
+				if err != nil || committer.Name == "" {
+					return fmt.Errorf("--git-committer=%s: must be provided as \"{name} <{email}>\"",
+						gitCommitter)
+				}
+				context.GitCommitterName = committer.Name
+				context.GitCommitterEmail = committer.Address
+			}
+
+			if err := upgrade.ValidateBranchTemplate(context.BranchTemplate); err != nil {
+				return fmt.Errorf("--branch-template: %w", err)
+			}
+
+			if context.SigningKey != "" {
+				context.SignCommits = true
+			}
+
+			if context.ContinueMerge && context.ResetUpstream {
+				return errors.New("--continue and --reset-upstream are mutually exclusive: " +
+					"resetting the upstream checkout discards the resolved merge")
+			}
+
+			if context.ContinueMerge && context.Isolated {
+				return errors.New("--continue and --isolated are mutually exclusive: " +
+					"an isolated checkout doesn't keep the resolved merge")
+			}
+
+			if context.WaitForChecks && context.ChecksTimeout <= 0 {
+				return fmt.Errorf("--checks-timeout=%s: must be positive", context.ChecksTimeout)
+			}
+
+			if context.MaxParallelSDKs < 1 {
+				return fmt.Errorf("--max-parallel-sdks=%d: must be at least 1", context.MaxParallelSDKs)
+			}
+
+			if context.SkipIfUpgradedWithin < 0 {
+				return fmt.Errorf("--skip-if-upgraded-within=%s: must not be negative",
+					context.SkipIfUpgradedWithin)
+			}
+
+			if context.KeepPlugins && context.RemovePlugins {
+				return errors.New("--keep-plugins and --remove-plugins are mutually exclusive")
+			}
+
+			step.Skip(skip...)
+			if context.Quiet {
+				reporter = step.NewQuietReporter()
+			}
+			if githubAnnotations || os.Getenv("GITHUB_ACTIONS") == "true" {
+				reporter = step.NewGitHubActionsReporter(reporter)
+			}
+			step.SetReporter(reporter)
+
+			if tracePath != "" {
+				// The file is closed when the process exits.
+				f, err := os.Create(tracePath)
+				if err != nil {
+					return fmt.Errorf("--trace=%s: %w", tracePath, err)
+				}
+				step.SetTrace(f)
+			}
+
+			if stepLogsDir != "" {
+				if err := step.SetLogDir(stepLogsDir); err != nil {
+					return fmt.Errorf("--step-logs-dir=%s: %w", stepLogsDir, err)
+				}
+			}
+
 			// Set repoPath if specified
 			context.SetRepoPath(repoPath)
 
+			if context.TargetFromUpstreamCheckout != "" {
+				if context.TargetVersion != nil {
+					return errors.New("--target-version and --target-from-upstream-checkout are mutually exclusive")
+				}
+				if !context.UpgradeProviderVersion {
+					return errors.New("cannot specify --target-from-upstream-checkout unless the provider will be upgraded")
+				}
+			}
+			switch target {
+			case "":
+			case "latest-upstream-release":
+				if context.TargetVersion != nil || context.InferVersion ||
+					context.TargetFromUpstreamCheckout != "" || context.TargetBranchTip != "" ||
+					context.TargetFromBranch != "" {
+					return errors.New("--target=latest-upstream-release cannot be combined with " +
+						"--target-version, --pulumi-infer-version, --target-from-upstream-checkout, " +
+						"--target-branch-tip or --target-from-branch")
+				}
+				if !context.UpgradeProviderVersion {
+					return errors.New("cannot specify --target unless the provider will be upgraded")
+				}
+				context.TargetLatestUpstreamRelease = true
+			default:
+				return fmt.Errorf("--target=%s invalid. Must be `latest-upstream-release`.", target)
+			}
+			if context.TargetBranchTip != "" {
+				if context.TargetFromUpstreamCheckout != "" {
+					return errors.New("--target-branch-tip and --target-from-upstream-checkout are mutually exclusive")
+				}
+				if !context.UpgradeProviderVersion {
+					return errors.New("cannot specify --target-branch-tip unless the provider will be upgraded")
+				}
+			}
+			if context.TargetFromBranch != "" {
+				if context.TargetVersion != nil || context.InferVersion ||
+					context.TargetFromUpstreamCheckout != "" || context.TargetBranchTip != "" {
+					return errors.New("--target-from-branch cannot be combined with " +
+						"--target-version, --pulumi-infer-version, --target-from-upstream-checkout " +
+						"or --target-branch-tip")
+				}
+				if !context.UpgradeProviderVersion {
+					return errors.New("cannot specify --target-from-branch unless the provider will be upgraded")
+				}
+			}
 			if context.TargetVersion != nil && !context.UpgradeProviderVersion {
 				return fmt.Errorf(
 					"cannot specify the provider version unless the provider will be upgraded")
 			}
+			if len(context.AdditionalUpstreams) > 0 && !context.UpgradeProviderVersion {
+				return fmt.Errorf(
+					"cannot specify --upstream unless the provider will be upgraded")
+			}
 			return nil
 		},
 		Run: func(_ *cobra.Command, args []string) {
-			err := upgrade.UpgradeProvider(context, repoOrg, repoName)
+			var err error
+			if providersFile != "" {
+				providers, err := upgrade.ReadProvidersFile(context, providersFile)
+				exitOnError(err)
+				exitOnError(upgrade.UpgradeProviders(context, providers))
+				return
+			}
+			if printUpstreamURLs {
+				exitOnError(upgrade.PrintUpstreamURLs(context, repoOrg, repoName))
+				return
+			}
+			if emitGoModJSON {
+				exitOnError(upgrade.EmitGoModJSON(context, repoOrg, repoName))
+				return
+			}
+			if reportOnly {
+				exitOnError(upgrade.ReportVersions(context, repoOrg, repoName))
+				return
+			}
+			if timeout > 0 {
+				err = runWithTimeout(context, reporter, timeout, repoOrg, repoName)
+			} else {
+				err = upgrade.UpgradeProvider(context, repoOrg, repoName)
+			}
 			if err != nil && context.CreateFailureIssue {
 				// $GITHUB_ACTION is a default env var within github
 				// actions, but is unlikely to be defined elsewhere.
@@ -164,24 +447,195 @@ func cmd() *cobra.Command {
 		},
 	}
 
+	cmd.PersistentFlags().StringVar(&envFile, "env-file", "",
+		`A dotenv style file of KEY=VALUE lines, set in the environment of every command run.
+Variables that are already set in the environment, or set by --env, take precedence.
+The values of secrets, such as *_TOKEN variables, are redacted from --trace and --step-logs-dir.`)
+
+	cmd.PersistentFlags().StringArrayVar(&envVars, "env", nil,
+		`A KEY=VALUE variable to set in the environment of every command run. Can be repeated.
+Overrides the environment and --env-file. The values of secrets, such as *_TOKEN variables,
+are redacted from --trace and --step-logs-dir.`)
+
+	cmd.PersistentFlags().StringVar(&providersFile, "providers-file", "",
+		`Upgrade each provider listed in a file instead of a single [provider].
+The file lists one {org}/{repo} per line, optionally followed by a target version, or is a
+YAML list of entries with the keys name, version and upstream-provider-name.`)
+
 	cmd.PersistentFlags().StringVar(&repoPath, "repo-path", "",
 		`Clone the provider repo to the specified path.`)
 
+	cmd.PersistentFlags().StringVar(&context.ProviderRepoURL, "provider-repo-url", "",
+		`Clone the provider repo from this URL instead of https://github.com/{org}/{repo}, such as
+"https://gitlab.example.com/providers/pulumi-foo.git". Unless --repo-path is set, the repo is
+cloned under $GOPATH/src by the host and path of the URL.`)
+
+	cmd.PersistentFlags().IntVar(&context.CloneDepth, "clone-depth", 0,
+		`Create shallow clones with the given depth. Forked upstreams are unshallowed before merging.`)
+
+	cmd.PersistentFlags().BoolVar(&context.Isolated, "isolated", false,
+		`Clone forked upstreams into a temporary directory for this run.
+Otherwise the checkout in $GOPATH is locked, so concurrent upgrades take turns.`)
+
+	cmd.PersistentFlags().BoolVar(&context.NoLock, "no-lock", false,
+		`Don't lock the provider repo against concurrent runs of upgrade-provider. By default a
+run fails when another run holds the lock.`)
+
 	cmd.PersistentFlags().StringVar(&targetVersion, "target-version", "",
 		`Upgrade the provider to the passed version.
 
 If the passed version does not exist, an error is signaled.`)
 
+	cmd.PersistentFlags().StringVar(&versionConstraint, "version-constraint", "",
+		`Only upgrade to upstream versions that satisfy the constraint, such as "~5" to stay on 5.x.
+The highest satisfying version is selected.`)
+
+	cmd.PersistentFlags().StringArrayVar(&additionalUpstreams, "upstream", nil,
+		`An additional upstream provider to upgrade, as {name}={version}. May be repeated.
+
+Only composite providers, which bridge more than one upstream provider, need this.`)
+
+	cmd.PersistentFlags().StringVar(&context.TargetFromUpstreamCheckout, "target-from-upstream-checkout", "",
+		`Upgrade the provider to the commit checked out in a local clone of the upstream provider.
+The version is the latest tag reachable from the checked out commit.`)
+
+	cmd.PersistentFlags().IntVar(&context.MaxMajorJump, "max-major-jump", 1,
+		`Abort if the target upstream major version is more than this many majors ahead of the
+current one. 0 disables the check.`)
+
+	cmd.PersistentFlags().BoolVar(&context.StrictSemver, "strict-semver", false,
+		`Require target and upstream versions to be fully specified as MAJOR.MINOR.PATCH.
+Otherwise partial versions are accepted, so "1.2" is read as 1.2.0.`)
+
+	cmd.PersistentFlags().StringVar(&target, "target", "",
+		`How to discover the target version. "latest-upstream-release" targets the release GitHub
+marks as the latest release of the upstream repo, found from the upstream module path.`)
+
+	cmd.PersistentFlags().StringVar(&context.TargetBranchTip, "target-branch-tip", "",
+		`Upgrade the provider to the commit at the tip of the given upstream branch.
+The version is --target-version if set, otherwise the latest upstream release.`)
+
+	cmd.PersistentFlags().StringVar(&context.TargetFromBranch, "target-from-branch", "",
+		`Upgrade the provider to the version that the given branch name ends in, such as
+"deps/upstream-v5.2.0". The version must be a full MAJOR.MINOR.PATCH version.`)
+
 	cmd.PersistentFlags().BoolVar(&context.InferVersion, "pulumi-infer-version", false,
 		`Use our GH issues to infer the target upgrade version.
 		If both '--target-version' and '--pulumi-infer-version' are passed,
 		we take '--target-version' to cap the inferred version. [Hidden behind PULUMI_DEV]`)
+	cmd.PersistentFlags().IntVar(&context.IssueLimit, "issue-limit", 100,
+		`The number of issues to list at once when inferring the target version from GH issues.
+If the limit is reached, the limit is doubled and the issues are listed again.`)
+	cmd.PersistentFlags().BoolVar(&context.AnyAuthor, "any-author", false,
+		`Infer the target version from upgrade issues filed by anyone, not just pulumi-bot.
+The issue title must still match "Upgrade terraform-provider-<name> to <version>".`)
+	cmd.PersistentFlags().StringVar(&context.IssueState, "issue-state", "open",
+		`The state of the upgrade issues to infer the target version from: "open", "closed" or "all".`)
 	err := cmd.PersistentFlags().MarkHidden("pulumi-infer-version")
 	contract.AssertNoErrorf(err, "could not mark `pulumi-infer-version` flag as hidden")
 
+	cmd.PersistentFlags().BoolVar(&reportOnly, "report-only", false,
+		`Report the pinned and latest available upstream versions as CSV, without upgrading.
+Combine with --quiet to only display the CSV.`)
+
+	cmd.PersistentFlags().BoolVar(&emitGoModJSON, "emit-gomod-json", false,
+		`Discover the provider repo, then print the analysis of its go.mod as JSON and exit: the
+kind of the repo, its upstream, fork and bridge modules.`)
+
+	cmd.PersistentFlags().BoolVar(&printUpstreamURLs, "print-upstream-url", false,
+		`Display the clone URL and location of the provider repo and its upstream, without
+cloning or upgrading anything.`)
+
+	cmd.PersistentFlags().BoolVar(&context.Gofmt, "gofmt", false,
+		`Run gofmt on the provider directory after "make tfgen", committing the result with
+the output of "make tfgen".`)
+
+	cmd.PersistentFlags().BoolVar(&context.Goimports, "goimports", false,
+		`Like --gofmt, but run goimports, which also fixes imports. goimports must be on PATH.`)
+
+	cmd.PersistentFlags().BoolVar(&context.RegenerateExamples, "regenerate-examples", false,
+		`Regenerate the example programs of the provider after building the SDKs, with
+"make {examples-target}", committing the result. A Makefile without the target is a warning.`)
+
+	cmd.PersistentFlags().StringVar(&context.ExamplesTarget, "examples-target", "examples",
+		`The make target run by --regenerate-examples.`)
+
+	cmd.PersistentFlags().StringVar(&color, "color", "auto",
+		`When to color the output: "always", "never" or "auto", which colors the output only when
+it is a terminal and NO_COLOR is not set.`)
+
+	cmd.PersistentFlags().BoolVar(&githubAnnotations, "github-annotations", false,
+		`Group the output and annotate failures and warnings with GitHub Actions workflow commands.
+Enabled by default when GITHUB_ACTIONS=true.`)
+
+	cmd.PersistentFlags().StringVar(&tracePath, "trace", "",
+		`Write a shell script of every command the upgrade runs to this file, with the directory
+it ran in and its full arguments. Secrets are redacted.`)
+
+	cmd.PersistentFlags().StringVar(&stepLogsDir, "step-logs-dir", "",
+		`Write the output of each step to its own file in this directory, named after the step.
+The directory is created if it is missing.`)
+
+	cmd.PersistentFlags().BoolVar(&context.PrintSteps, "print-steps", false,
+		`Discover the repository, then display the names of the steps that would run and exit.
+Step names can be passed to --skip.`)
+
+	cmd.PersistentFlags().BoolVarP(&context.Quiet, "quiet", "q", false,
+		`Only display failures, warnings and a final summary.`)
+
+	cmd.PersistentFlags().StringArrayVar(&skip, "skip", nil,
+		`Skip a step by name. May be repeated. The name of a step is its displayed description,
+or the command as written for command steps, such as "make build_sdks".`)
+
+	cmd.PersistentFlags().DurationVar(&timeout, "timeout", 0,
+		`The maximum duration of the whole upgrade, such as "1h30m". When exceeded, the
+running command is killed and the upgrade fails. Unlimited if not set.`)
+
 	cmd.PersistentFlags().BoolVar(&context.MajorVersionBump, "major", false,
 		`Upgrade the provider to a new major version.`)
 
+	cmd.PersistentFlags().StringVar(&context.GoProxy, "goproxy", "",
+		`The GOPROXY used by "go get" and "go mod tidy", such as "direct".
+If not set, the GOPROXY of the environment is used.`)
+
+	cmd.PersistentFlags().StringVar(&bridgeVersionConstraint, "bridge-version-constraint", "",
+		`Only upgrade pulumi-terraform-bridge to a version that satisfies the constraint, such as
+"<3.60.0", and fail if "go mod tidy" resolves the bridge outside of it.`)
+
+	cmd.PersistentFlags().StringVar(&compatMatrix, "compat-matrix", "",
+		`A YAML file mapping pulumi-terraform-bridge versions to the pulumi SDK version to pin
+when upgrading the bridge, such as "v3.60.0: v3.78.1". For bridge versions that aren't
+listed, the SDK is upgraded with "go get -u". If not set, a built in matrix is used.`)
+
+	cmd.PersistentFlags().StringVar(&context.GoFlags, "goflags", "",
+		`The GOFLAGS used by go and make commands, such as "-mod=mod".
+If not set, the GOFLAGS of the environment is used.`)
+
+	cmd.PersistentFlags().StringVar(&context.GoPrivate, "goprivate", "",
+		`The GOPRIVATE used by go and make commands, such as "github.com/my-org/*", for
+upstreams that are private modules. Private modules are neither fetched through the
+proxy nor verified against the checksum database. If not set, the GOPRIVATE of the
+environment is used.`)
+
+	cmd.PersistentFlags().StringVar(&context.GoNoSumDB, "gonosumdb", "",
+		`The GONOSUMDB used by go and make commands: the modules that are not verified against
+the checksum database, such as a private fork of the upstream. If not set, the GONOSUMDB
+of the environment is used.`)
+
+	cmd.PersistentFlags().BoolVar(&context.RepairGoSum, "repair-go-sum", false,
+		`When tidying or building the provider fails with a "missing go.sum entry" error,
+run "go mod download" and "go mod tidy" in the provider directory and retry once.`)
+
+	cmd.PersistentFlags().BoolVar(&context.BumpGoDirective, "bump-go-directive", false,
+		`When a tidy or build of the provider fails because a dependency, such as the bridge,
+requires a newer go, raise the go directive of the provider with "go mod edit -go" and retry.`)
+
+	cmd.PersistentFlags().StringVar(&context.TagPrefix, "tag-prefix", "v",
+		`The prefix of upstream release tags. The tag for version 1.2.3 is "<prefix>1.2.3".`)
+
+	cmd.PersistentFlags().BoolVar(&context.Force, "force", false,
+		`Upgrade the provider even if it already pins the target upstream version.`)
+
 	cmd.PersistentFlags().StringSliceVar(&upgradeKind, "kind", []string{"all"},
 		`The kind of upgrade to perform:
 - "all":     Upgrade the upstream provider and the bridge. Shorthand for "bridge,provider,code".
@@ -197,25 +651,254 @@ If the passed version does not exist, an error is signaled.`)
 		`A comma separated list of code migration to perform:
 - "autoalias": Apply auto aliasing to the provider.`)
 
+	cmd.PersistentFlags().StringVar(&context.PulumiOrg, "pulumi-org", "pulumi",
+		`The org of providers passed as just {repo}, such as "pulumiverse" for community providers.
+The org of the upstream fork is configured separately, with --fork-remote-url.`)
+
 	cmd.PersistentFlags().StringVar(&context.UpstreamProviderName, "upstream-provider-name", "",
 		`The name of the upstream provider.
 Required unless running from provider root and set in upgrade-config.yml.`)
 
+	cmd.PersistentFlags().StringVar(&context.UpstreamOwnerRepo, "upstream-owner-repo", "",
+		`The {owner}/{repo} of the upstream provider on GitHub, such as
+"hashicorp/terraform-provider-aws". If set, it is used to clone the upstream, to name the
+pulumi fork and to look up upstream tags and releases, instead of the repo derived from
+the upstream module path.`)
+
 	cmd.PersistentFlags().BoolVar(&context.RemovePlugins, "remove-plugins", false,
 		`Remove all pulumi plugins from cache before running the upgrade.
 		It is possible that the generated examples may be non-deterministic depending on which
 		plugins are used if existing versions are present in the cache.`)
 
+	cmd.PersistentFlags().BoolVar(&context.KeepPlugins, "keep-plugins", false,
+		`Never touch the local pulumi plugin cache. Cannot be combined with --remove-plugins.`)
+
 	cmd.PersistentFlags().StringVar(&context.PrReviewers, "pr-reviewers", "",
 		`A comma separated list of reviewers to assign the upgrade PR to.`)
 
+	cmd.PersistentFlags().StringSliceVar(&context.PrLabels, "labels", nil,
+		`Labels to add to the upgrade PR. May be repeated or comma separated.`)
+
+	cmd.PersistentFlags().StringVar(&context.PrMilestone, "milestone", "",
+		`The milestone to add the upgrade PR to.`)
+
+	cmd.PersistentFlags().StringVar(&context.PrAssignee, "assignee", "@me",
+		`The user to assign the upgrade PR and the issues it closes to.`)
+
+	cmd.PersistentFlags().BoolVar(&context.Draft, "draft", false,
+		`Open the upgrade PR as a draft. PRs that need manual follow-up are always drafts.`)
+
 	cmd.PersistentFlags().BoolVarP(&context.AllowMissingDocs, "allow-missing-docs", "", false,
 		`If true, don't error on missing docs during tfgen.
 This is equivalent to setting PULUMI_MISSING_DOCS_ERROR=${! VALUE}.`)
 
+	cmd.PersistentFlags().BoolVar(&context.VerifyBuild, "verify-build", false,
+		`Run "go build ./..." and "go vet ./..." in the provider directory before "make tfgen",
+so compile errors are reported early.`)
+
+	cmd.PersistentFlags().StringSliceVar(&context.SDKLanguages, "sdk-languages", nil,
+		`Only build the SDKs of these languages, such as "go,nodejs", with "make build_{language}".
+If not set, every SDK is built with "make build_sdks".`)
+
+	cmd.PersistentFlags().IntVar(&context.MaxParallelSDKs, "max-parallel-sdks", 1,
+		`The maximum number of SDKs to build at once. The SDKs are built by a single
+"make -j{n} build_{language}...", so prerequisites shared by the languages are only built
+once. Falls back to "make build_sdks" if the Makefile has no per-language targets.`)
+
+	cmd.PersistentFlags().BoolVar(&context.VerifyPlugin, "verify-plugin", false,
+		`Start the built provider plugin after "make build_sdks" and check that it serves its schema.
+The pulumi-resource-{name} binary in bin/ is used, or the one on PATH if bin/ has none.`)
+
+	cmd.PersistentFlags().BoolVar(&context.CheckBreakingChanges, "check-breaking-changes", false,
+		`After "make tfgen", compare the schema against the default branch. Removed resources,
+functions, types or properties and newly required inputs are reported, and the PR is labeled
+`+"`needs-release/major`"+`.`)
+
+	cmd.PersistentFlags().BoolVar(&context.WaitForChecks, "wait-for-checks", false,
+		`After opening the upgrade PR, wait for its required checks to complete. The upgrade fails
+if a required check fails.`)
+
+	cmd.PersistentFlags().DurationVar(&context.ChecksTimeout, "checks-timeout", 30*time.Minute,
+		`The maximum duration to wait for the required checks with --wait-for-checks.`)
+
 	cmd.PersistentFlags().BoolVar(&context.CreateFailureIssue, "create-failure-issue", false,
 		`Create an issue in the target repository if the upgrade attempt fails in CI.`)
 
+	cmd.PersistentFlags().StringVar(&context.CommitStyle, "commit-style", "plain",
+		`The style of generated commit messages:
+- "plain":        Describe the command that produced the commit, such as "make tfgen".
+- "conventional": Use conventional commits, such as "chore(deps): upgrade terraform-provider-x to v1.2.3".`)
+
+	cmd.PersistentFlags().StringVar(&context.CommitType, "commit-type", "chore",
+		`The type of conventional commit messages.`)
+
+	cmd.PersistentFlags().StringVar(&context.CommitScope, "commit-scope", "",
+		`The scope of conventional commit messages. Each commit has a default scope if not set.`)
+
+	cmd.PersistentFlags().StringVar(&context.ReportFormat, "report-format", "text",
+		`The format of the summary displayed after the upgrade:
+- "text":     A human readable list, only displayed with --quiet.
+- "json":     A JSON object, for tooling.
+- "markdown": Tables of the versions and step results, for pasting into PRs and issues.`)
+
+	cmd.PersistentFlags().StringVar(&gitCommitter, "git-committer", "",
+		`The committer of the commits made by the upgrade, as "{name} <{email}>".
+The author is unchanged. If not set, git's defaults are used.`)
+
+	cmd.PersistentFlags().StringVar(&context.BranchTemplate, "branch-template", "",
+		`The name of the working branch. {name} is replaced with the name of what is upgraded,
+{version} with the version it is upgraded to, {major} with the major version of the
+provider after the upgrade and {date} with today's date. Defaults to upgrade-{name}-to-{version}.`)
+
+	cmd.PersistentFlags().BoolVar(&context.DeleteRemoteBranchOnNoop, "delete-remote-branch-on-noop", false,
+		`When there is nothing to upgrade, delete the remote branches of previous upgrades to the
+current upstream and bridge versions.`)
+
+	cmd.PersistentFlags().DurationVar(&context.SkipIfUpgradedWithin, "skip-if-upgraded-within", 0,
+		`Skip the provider if it was upgraded within this duration, as found by an upgrade commit
+on the default branch or a recently pushed upgrade branch. Useful for frequent scheduled runs.`)
+
+	cmd.PersistentFlags().BoolVar(&context.SignCommits, "sign-commits", false,
+		`Sign the commits made by the upgrade, for repos that require signed commits.
+The upgrade fails early if no signing key is configured.`)
+
+	cmd.PersistentFlags().StringVar(&context.SigningKey, "signing-key", "",
+		`The key to sign commits with, passed to "git commit --gpg-sign". Implies --sign-commits.
+If not set, git's user.signingkey is used.`)
+
+	cmd.PersistentFlags().StringVar(&context.CommitMode, "commit-mode", "two",
+		`How the changes of the upgrade are grouped into commits:
+- "two":      Commit after "make tfgen" and after "make build_sdks".
+- "squash":   Commit all changes of the upgrade at once, at the end.
+- "per-step": Like "two", but also commit the updated dependencies before "make tfgen".`)
+
+	cmd.PersistentFlags().StringArrayVar(&context.PostStepHooks, "post-step-hook", nil,
+		`A shell command to run in the provider repo after the upgrade, before pushing.
+May be repeated. Changes made by hooks are committed. A failing hook fails the upgrade.`)
+
+	cmd.PersistentFlags().StringArrayVar(&context.OptionalPostStepHooks, "optional-post-step-hook", nil,
+		`Like --post-step-hook, but a failing hook only displays a warning.`)
+
+	cmd.PersistentFlags().StringVar(&context.ForkRemoteURL, "fork-remote-url", "",
+		`For forked providers, the URL of the pulumi fork to push the upgraded upstream to.
+Defaults to https://github.com/pulumi/terraform-provider-{name}.git.`)
+
+	cmd.PersistentFlags().StringVar(&context.ForkUpstreamCommit, "fork-upstream-commit", "",
+		`For forked providers, the commit of the fork to pin in the provider's replace directive.
+Defaults to the head of the upgraded upstream branch.`)
+
+	cmd.PersistentFlags().BoolVar(&context.BumpTransitiveForks, "bump-transitive-forks", false,
+		`For forked providers, also bump replaces in the fork's go.mod that point to other
+pulumi maintained repos to the head of the fork's upstream-v{version} branch for the
+required version of the dependency.`)
+
+	cmd.PersistentFlags().BoolVar(&context.ResetUpstream, "reset-upstream", false,
+		`For forked providers, discard an unfinished merge or uncommitted changes left in the
+upstream checkout by an interrupted run, with "git merge --abort" and "git reset --hard".
+Without it, the upgrade fails when the upstream checkout is dirty.`)
+
+	cmd.PersistentFlags().BoolVar(&context.ContinueMerge, "continue", false,
+		`For forked providers, continue after resolving the conflicts of the upstream merge by hand.
+The merge must be committed on the upstream-v{version} branch of the upstream checkout.`)
+
+	cmd.PersistentFlags().BoolVar(&context.ConfirmVersion, "confirm-version", false,
+		`Display the target upstream version after discovery, and ask for confirmation before
+upgrading to it.`)
+
+	cmd.PersistentFlags().BoolVar(&context.Yes, "yes", false,
+		`Answer yes to any confirmation prompt.`)
+
+	cmd.PersistentFlags().BoolVar(&context.Strict, "strict", false,
+		`Fail on detected inconsistencies in the provider repo instead of warning.`)
+
+	cmd.PersistentFlags().BoolVar(&context.RequireFreshBase, "require-fresh-base", false,
+		`Abort before pushing if the remote default branch has moved since the upgrade started.
+Otherwise, a warning is displayed.`)
+
+	cmd.PersistentFlags().StringVar(&context.SlackWebhook, "slack-webhook", "",
+		`A Slack incoming webhook URL to notify when the upgrade completes.
+Failure to notify does not fail the upgrade.`)
+
+	cmd.PersistentFlags().BoolVar(&context.SummaryToPRComment, "output-summary-to-pr-comment", false,
+		`Post the markdown summary of the upgrade as a comment on the upgrade PR. A comment posted
+by a previous run is updated instead. Failure to comment does not fail the upgrade.`)
+
+	cmd.AddCommand(rebuildSDKsCmd(&context, &repoOrg, &repoName, exitOnError))
+	cmd.AddCommand(planCmd(&context, &repoOrg, &repoName, exitOnError))
+	cmd.AddCommand(applyCmd(cmd, &context))
+
+	return cmd
+}
+
+// The plan subcommand. The provider is parsed by the root command.
+func planCmd(
+	context *upgrade.Context, repoOrg, repoName *string, exitOnError func(error),
+) *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "plan [provider]",
+		Short: "Write the plan of an upgrade to a file, without upgrading",
+		Long: `Discover the provider and write the plan of its upgrade to a JSON file: the repo kind,
+the versions to upgrade to and the steps that would run.
+
+The plan can be reviewed, then executed with "upgrade-provider apply".`,
+		Args: cobra.RangeArgs(0, 1),
+		Run: func(*cobra.Command, []string) {
+			exitOnError(upgrade.WritePlan(*context, *repoOrg, *repoName, output))
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "plan.json",
+		`The file to write the plan to.`)
+	return cmd
+}
+
+// The apply subcommand. It runs the root command against the provider of the plan.
+func applyCmd(root *cobra.Command, context *upgrade.Context) *cobra.Command {
+	var plan *upgrade.Plan
+	return &cobra.Command{
+		Use:   "apply <plan>",
+		Short: "Upgrade a provider as described by a plan",
+		Long: `Upgrade a provider as described by a plan written by "upgrade-provider plan".
+
+The repository is set up again, but the versions to upgrade to are taken from the plan.
+The upgrade fails if the kind of the provider changed since the plan was written.`,
+		Args: cobra.ExactArgs(1),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			plan, err = upgrade.ReadPlan(args[0])
+			if err != nil {
+				return err
+			}
+			return root.PersistentPreRunE(cmd, []string{plan.Repo})
+		},
+		Run: func(cmd *cobra.Command, _ []string) {
+			*context = plan.Apply(*context)
+			root.Run(cmd, nil)
+		},
+	}
+}
+
+// The rebuild-sdks subcommand. The provider is parsed by the root command.
+func rebuildSDKsCmd(
+	context *upgrade.Context, repoOrg, repoName *string, exitOnError func(error),
+) *cobra.Command {
+	var branch string
+	cmd := &cobra.Command{
+		Use:   "rebuild-sdks [provider]",
+		Short: "Regenerate the SDKs on an existing upgrade branch",
+		Long: `Regenerate the SDKs on an existing upgrade branch, then commit and push them.
+
+Only "make build_sdks" is run, so this is useful when the upgrade itself succeeded but the
+SDKs need to be rebuilt, such as after fixing the Makefile.`,
+		Args: cobra.RangeArgs(0, 1),
+		Run: func(*cobra.Command, []string) {
+			exitOnError(upgrade.RebuildSDKs(*context, *repoOrg, *repoName, branch))
+		},
+	}
+	cmd.Flags().StringVar(&branch, "branch", "",
+		`The existing upgrade branch to rebuild the SDKs on.`)
+	contract.AssertNoErrorf(cmd.MarkFlagRequired("branch"),
+		"could not mark `branch` flag as required")
 	return cmd
 }
 
@@ -224,6 +907,69 @@ func main() {
 	contract.IgnoreError(err)
 }
 
+// Run the upgrade, bounded by timeout.
+//
+// If the timeout expires, the step that was running is reported.
+func runWithTimeout(
+	ctx upgrade.Context, reporter step.Reporter, timeout time.Duration, repoOrg, repoName string,
+) error {
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, timeout)
+	defer cancel()
+
+	r := &currentStepReporter{Reporter: reporter}
+	step.SetReporter(r)
+	err := upgrade.UpgradeProvider(ctx, repoOrg, repoName)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s while running %q", timeout, r.current)
+	}
+	return err
+}
+
+// A step.Reporter that remembers the most recently started step.
+type currentStepReporter struct {
+	step.Reporter
+	current string
+}
+
+func (r *currentStepReporter) StartStep(depth int, description string) {
+	r.current = description
+	r.Reporter.StartStep(depth, description)
+}
+
+// Set the variables of a dotenv style file in our environment, so they are inherited by
+// every command we run. Variables that are already set are left alone. The values of
+// secrets are redacted from traces and logs.
+func loadEnvFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return fmt.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		step.AddSecretEnv(key, value)
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
 // Adapted from https://github.com/carolynvs/stingoftheviper/blob/main/main.go
 func initializeConfig(cmd *cobra.Command) error {
 	v := viper.New()
@@ -272,6 +1018,15 @@ func bindFlags(cmd *cobra.Command, v *viper.Viper) {
 		// Apply the viper config value to the flag when the flag is not set and viper has a value
 		if !f.Changed && v.IsSet(f.Name) {
 			val := v.Get(f.Name)
+			// A list in the config file sets each of its values, as if the flag was
+			// repeated.
+			if list, ok := val.([]any); ok {
+				for _, elem := range list {
+					err := cmd.Flags().Set(f.Name, fmt.Sprintf("%v", elem))
+					contract.AssertNoErrorf(err, "error setting flag")
+				}
+				return
+			}
 			err := cmd.Flags().Set(f.Name, fmt.Sprintf("%v", val))
 			contract.AssertNoErrorf(err, "error setting flag")
 		}
@@ -308,6 +1063,7 @@ func createFailureIssue(ctx upgrade.Context, repoOrg string, repoName string) (s
 	)
 	ghSearchBytes := new(bytes.Buffer)
 	getIssues.Stdout = ghSearchBytes
+	step.Trace(getIssues)
 	err := getIssues.Run()
 	if err != nil {
 		return "createFailureIssue error: failed to search existing issues", err
@@ -330,6 +1086,7 @@ func createFailureIssue(ctx upgrade.Context, repoOrg string, repoName string) (s
 			"--title="+title,
 			"--label="+"needs-triage",
 		)
+		step.Trace(cmd)
 		if err := cmd.Run(); err != nil {
 			return "createFailureIssue error: failed to create new issue", err
 		}
@@ -343,6 +1100,7 @@ func createFailureIssue(ctx upgrade.Context, repoOrg string, repoName string) (s
 			"--repo="+repoOrg+"/"+repoName,
 			"--body="+fmt.Sprintf("%s\n\nView the latest workflow run: %s", title, workflowURL),
 		)
+		step.Trace(cmd)
 		if err := cmd.Run(); err != nil {
 			return "createFailureIssue error: Failed to update existing issue", err
 		}
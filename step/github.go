@@ -0,0 +1,64 @@
+package step
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+)
+
+// Create a Reporter that emits GitHub Actions workflow commands around the output of r.
+//
+// Top level jobs are displayed as collapsible groups, failed steps as error annotations
+// and steps with warnings as warning annotations.
+func NewGitHubActionsReporter(r Reporter) Reporter {
+	return &githubActionsReporter{Reporter: r}
+}
+
+type githubActionsReporter struct {
+	Reporter
+}
+
+func (g *githubActionsReporter) StartJob(depth int, description string) {
+	// GitHub Actions doesn't support nested groups.
+	if depth == 0 {
+		fmt.Println("::group::" + escapeWorkflowCommand(description))
+	}
+	g.Reporter.StartJob(depth, description)
+}
+
+func (g *githubActionsReporter) FinishStep(
+	depth int, description string, status Status, msg string, dur time.Duration,
+) {
+	g.Reporter.FinishStep(depth, description, status, msg, dur)
+	var command string
+	switch {
+	case status == Failed:
+		command = "error"
+	case colorize.HasWarning(msg):
+		command = "warning"
+	default:
+		return
+	}
+	fmt.Printf("::%s title=%s::%s\n", command,
+		escapeWorkflowProperty(description), escapeWorkflowCommand(colorize.Strip(msg)))
+}
+
+func (g *githubActionsReporter) FinishJob(depth int, description string, status Status) {
+	g.Reporter.FinishJob(depth, description, status)
+	if depth == 0 {
+		fmt.Println("::endgroup::")
+	}
+}
+
+// Escape the message of a workflow command.
+func escapeWorkflowCommand(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// Escape a property of a workflow command, such as its title.
+func escapeWorkflowProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A",
+		":", "%3A", ",", "%2C").Replace(s)
+}
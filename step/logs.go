@@ -0,0 +1,57 @@
+package step
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+)
+
+var (
+	logDir string
+	// The number of logs written, which orders the logs in the order the steps ran.
+	logCount int
+)
+
+// SetLogDir writes the output of each step that runs to its own file in dir, named after
+// the step, such as "012-make_build_sdks.log". dir is created if it is missing.
+//
+// Passing an empty dir stops writing logs.
+func SetLogDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	logDir, logCount = dir, 0
+	return nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Write the log of the step name. The same step can run more than once, so logs are
+// numbered.
+func writeLog(name, stdout, stderr, result string) {
+	logCount++
+	base := strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_")
+	if len(base) > 80 {
+		base = base[:80]
+	}
+	path := filepath.Join(logDir, fmt.Sprintf("%03d-%s.log", logCount, base))
+
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "# %s\n", name)
+	if stdout != "" {
+		fmt.Fprintf(b, "\n## stdout\n\n%s\n", strings.TrimRight(redact(stdout), "\n"))
+	}
+	if stderr != "" {
+		fmt.Fprintf(b, "\n## stderr\n\n%s\n", strings.TrimRight(redact(stderr), "\n"))
+	}
+	fmt.Fprintf(b, "\n## result\n\n%s\n", redact(colorize.Strip(result)))
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the log of %q: %s\n", name, err)
+	}
+}
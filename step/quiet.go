@@ -0,0 +1,42 @@
+package step
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+)
+
+// Create a Reporter that only displays failed steps and steps with warnings.
+//
+// Each displayed step is preceded by the jobs that contain it.
+func NewQuietReporter() Reporter {
+	return &quietReporter{}
+}
+
+type quietReporter struct {
+	jobs []string
+}
+
+func (q *quietReporter) StartJob(depth int, description string) {
+	q.jobs = append(q.jobs[:depth], description)
+}
+
+func (*quietReporter) StartStep(int, string) {}
+
+func (q *quietReporter) FinishStep(depth int, description string, status Status, msg string, _ time.Duration) {
+	if status != Failed && !colorize.HasWarning(msg) {
+		return
+	}
+	mark := "X"
+	if status != Failed {
+		mark = "!"
+	}
+	path := append(append([]string{}, q.jobs[:depth]...), description)
+	fmt.Printf("%s %s: %s\n", mark, strings.Join(path, " > "), colorize.Display(msg))
+}
+
+func (q *quietReporter) FinishJob(depth int, _ string, _ Status) {
+	q.jobs = q.jobs[:depth]
+}
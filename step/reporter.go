@@ -0,0 +1,160 @@
+package step
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/briandowns/spinner"
+	"github.com/mattn/go-isatty"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+)
+
+// The outcome of a step or job.
+type Status int
+
+const (
+	Succeeded Status = iota
+	Failed
+	Skipped
+)
+
+func (s Status) String() string {
+	switch s {
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Skipped:
+		return "skipped"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
+// A Reporter displays the progress of running steps.
+//
+// A job is a named group of steps created by Combined. depth is the nesting level of
+// the job or step: top level jobs have a depth of 0.
+type Reporter interface {
+	// Called before any step of a job is run.
+	StartJob(depth int, description string)
+	// Called before an atomic step is run.
+	StartStep(depth int, description string)
+	// Called after an atomic step is run. msg is either the result of the step or the
+	// error message if the step failed.
+	FinishStep(depth int, description string, status Status, msg string, dur time.Duration)
+	// Called after the last step of a job is run, or after the first step that failed.
+	FinishJob(depth int, description string, status Status)
+}
+
+var reporter Reporter = NewTextReporter()
+
+// Set the Reporter used by Run.
+func SetReporter(r Reporter) {
+	reporter = r
+}
+
+// The Reporter used by Run.
+func CurrentReporter() Reporter {
+	return reporter
+}
+
+// Create the default Reporter, which displays a spinner for each running step and a
+// nested list of finished steps.
+//
+// When stdout is not a terminal, the spinner is replaced by a periodic "still running"
+// line for long running steps.
+func NewTextReporter() Reporter {
+	return &textReporter{tty: isatty.IsTerminal(os.Stdout.Fd())}
+}
+
+const (
+	// How long a step runs before we display its elapsed time.
+	showElapsedAfter = 5 * time.Second
+	// How often we report a running step when stdout is not a terminal.
+	stillRunningInterval = 30 * time.Second
+)
+
+type textReporter struct {
+	tty     bool
+	spinner *spinner.Spinner
+	// Closed when the running step finishes, if stdout is not a terminal.
+	done chan struct{}
+}
+
+func (*textReporter) prefix(depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	return strings.Repeat("  ", depth-1) + "- "
+}
+
+func (t *textReporter) StartJob(depth int, description string) {
+	if depth == 0 {
+		fmt.Println("---- " + description + " ----")
+		return
+	}
+	fmt.Println(t.prefix(depth) + description)
+}
+
+func (t *textReporter) StartStep(depth int, description string) {
+	prefix := t.prefix(depth)
+	start := time.Now()
+	if !t.tty {
+		done := make(chan struct{})
+		t.done = done
+		go func() {
+			ticker := time.NewTicker(stillRunningInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					fmt.Printf("%s... still running (%s): %s\n", prefix,
+						time.Since(start).Round(time.Second), description)
+				}
+			}
+		}()
+		return
+	}
+	options := []string{"|", "/", "-", "\\"}
+	for i, o := range options {
+		options[i] = prefix + o + " " + description
+	}
+	t.spinner = spinner.New(options, time.Millisecond*250,
+		spinner.WithHiddenCursor(true))
+	t.spinner.PreUpdate = func(s *spinner.Spinner) {
+		if elapsed := time.Since(start); elapsed >= showElapsedAfter {
+			s.Suffix = fmt.Sprintf(" (%s)", elapsed.Round(time.Second))
+		}
+	}
+	t.spinner.Start()
+}
+
+func (t *textReporter) FinishStep(depth int, description string, status Status, msg string, _ time.Duration) {
+	mark := "✓"
+	switch status {
+	case Failed:
+		mark = "X"
+	case Skipped:
+		mark = "~"
+	}
+	if t.spinner != nil {
+		t.spinner.FinalMSG = t.prefix(depth) + mark
+		t.spinner.Stop()
+		t.spinner = nil
+	} else {
+		if t.done != nil {
+			close(t.done)
+			t.done = nil
+		}
+		fmt.Print(t.prefix(depth) + mark)
+	}
+	fmt.Printf(" %s: %s\n", description, colorize.Display(msg))
+}
+
+func (*textReporter) FinishJob(int, string, Status) {}
@@ -5,13 +5,15 @@
 package step
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 	"time"
 
-	"github.com/briandowns/spinner"
+	"github.com/pulumi/upgrade-provider/colorize"
 )
 
 // A Step represents an atomic (pass/fail) piece of computation that should be displayed
@@ -23,39 +25,67 @@ type Step interface {
 	AssignTo(lvalue *string) Step
 	// Override the output of the command, and assign the rvalue
 	Return(rvalue *string) Step
-	run(prefix string) bool
+	run(r Reporter, depth int) bool
+	plan(depth int, dir *string, visit PlanVisitor)
 }
 
+// A PlanVisitor is called for each step that would run, with the name of the step and the
+// directory it would run in. dir is empty if the step runs in the current directory.
+type PlanVisitor = func(depth int, name, dir string)
+
 type step struct {
 	description string
-	f           func() (string, error)
-	path        *string
-	rvalue      *string
+	// The stable name of the step, used to skip it.
+	name    string
+	f       func() (string, error)
+	path    *string
+	rvalue  *string
+	assigns bool
+	// The output of the command, for steps created by Cmd.
+	output *string
+	// The standard error of the command, for steps created by Cmd when logs are written.
+	stderr *string
 }
 
-func (ds step) run(prefix string) bool {
-	options := []string{"|", "/", "-", "\\"}
-	for i, o := range options {
-		options[i] = prefix + o + " " + ds.description
+func (ds step) run(r Reporter, depth int) bool {
+	if skipped[ds.name] {
+		return skip(r, depth, ds.description, ds.assigns)
 	}
-	spinner := spinner.New(options, time.Millisecond*250,
-		spinner.WithHiddenCursor(true))
-	spinner.Start()
+	r.StartStep(depth, ds.description)
+	start := time.Now()
 	result, err := runIn(ds.path, ds.f)
-	if err != nil {
-		spinner.FinalMSG = prefix + "X"
+	status := Succeeded
+	var noop skipError
+	if errors.As(err, &noop) {
+		status, result, err = Skipped, noop.reason, nil
+	} else if err != nil {
+		status = Failed
 		result = err.Error()
-	} else {
-		spinner.FinalMSG = prefix + "✓"
-		if result == "" {
-			result = "done"
-		}
+		lastFailure = &Failure{Step: ds.name, Err: err, Output: deref(ds.output)}
+	} else if result == "" {
+		result = "done"
 	}
-	spinner.Stop()
-	fmt.Printf(" %s: %s\n", ds.description, result)
+	if logDir != "" {
+		writeLog(ds.name, deref(ds.output), deref(ds.stderr), result)
+	}
+	r.FinishStep(depth, ds.description, status, result, time.Since(start))
 	return err == nil
 }
 
+func (ds step) plan(depth int, dir *string, visit PlanVisitor) {
+	if ds.path != nil {
+		dir = ds.path
+	}
+	visit(depth, ds.name, deref(dir))
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func (ds step) Return(rvalue *string) Step {
 	ds.rvalue = rvalue
 	return ds
@@ -65,25 +95,64 @@ func (ds step) Return(rvalue *string) Step {
 func F(description string, action func() (string, error)) Step {
 	return step{
 		description: description,
+		name:        description,
 		f:           action,
 	}
 }
 
+// Create a step based around a function that runs commands itself, such as a command that
+// is retried after its failure is repaired.
+//
+// The function sets *output to the output of its commands, which is kept like the output
+// of a step created by Cmd.
+func FOutput(description string, action func(output *string) (string, error)) Step {
+	var output string
+	return step{
+		description: description,
+		name:        description,
+		output:      &output,
+		f:           func() (string, error) { return action(&output) },
+	}
+}
+
 // Create a step from a *exec.Cmd.
+//
+// The name of the step is the command as written, such as "make tfgen".
 func Cmd(command *exec.Cmd) Step {
-	var output string
+	var output, stderr string
 	description := command.String()
 	if len(description) > 80 {
 		description = description[:80] + "..."
 	}
-	return F(description, func() (string, error) {
-		out, err := command.Output()
-		output = string(out)
-		if exit, ok := err.(*exec.ExitError); ok {
-			err = fmt.Errorf("%s:\n%s", err.Error(), string(exit.Stderr))
-		}
-		return "", err
-	}).Return(&output)
+	return step{
+		description: description,
+		name:        strings.Join(command.Args, " "),
+		rvalue:      &output,
+		output:      &output,
+		stderr:      &stderr,
+		f: func() (string, error) {
+			Trace(command)
+			// Standard error is only kept on failure, unless we write it to a log.
+			var stderrBuf *bytes.Buffer
+			if logDir != "" && command.Stderr == nil {
+				stderrBuf = new(bytes.Buffer)
+				command.Stderr = stderrBuf
+			}
+			out, err := command.Output()
+			output = string(out)
+			if stderrBuf != nil {
+				stderr = stderrBuf.String()
+			}
+			if exit, ok := err.(*exec.ExitError); ok {
+				errOut := string(exit.Stderr)
+				if stderrBuf != nil {
+					errOut = stderr
+				}
+				err = fmt.Errorf("%s:\n%s", err.Error(), errOut)
+			}
+			return "", err
+		},
+	}
 }
 
 // Set an environmental variable.
@@ -97,8 +166,12 @@ func Env(key, value string) Step {
 func (s step) AssignTo(position *string) Step {
 	return step{
 		description: s.description,
+		name:        s.name,
 		path:        s.path,
 		rvalue:      s.rvalue,
+		assigns:     true,
+		output:      s.output,
+		stderr:      s.stderr,
 		f: func() (string, error) {
 			r, err := s.f()
 			if s.rvalue != nil {
@@ -195,16 +268,27 @@ func (us unknownStep) Return(rvalue *string) Step {
 	}
 }
 
-func (us unknownStep) run(prefix string) bool {
+func (us unknownStep) plan(depth int, dir *string, visit PlanVisitor) {
+	if us.in != nil {
+		dir = us.in
+	}
+	// A computed step is only known when it runs.
+	visit(depth, "(computed when run)", deref(dir))
+}
+
+func (us unknownStep) run(r Reporter, depth int) bool {
 	s, err := runIn(us.in, func() (Step, error) { return us.f(), nil })
 	if err != nil {
-		fmt.Println("failed to compute step: %w", err)
+		const description = "Compute step"
+		r.StartStep(depth, description)
+		r.FinishStep(depth, description, Failed, err.Error(), 0)
+		lastFailure = &Failure{Err: err}
 		return false
 	}
 	if s == nil {
 		return true
 	}
-	return s.run(prefix)
+	return s.run(r, depth)
 }
 
 // Run a series of steps with an under a name.
@@ -239,13 +323,23 @@ func (c combined) AssignTo(position *string) Step {
 	return c
 }
 
-func (c combined) run(prefix string) bool {
-	description := prefix + c.description
-	if prefix == "" {
-		description = "---- " + description + " ----"
+func (c combined) plan(depth int, dir *string, visit PlanVisitor) {
+	if c.path != nil {
+		dir = c.path
 	}
-	fmt.Println(description)
-	subPrefix := strings.Repeat(" ", len(prefix))
+	visit(depth, c.description, deref(dir))
+	for _, s := range c.steps {
+		if s != nil {
+			s.plan(depth+1, dir, visit)
+		}
+	}
+}
+
+func (c combined) run(r Reporter, depth int) bool {
+	if skipped[c.description] {
+		return skip(r, depth, c.description, len(c.assignTo) > 0)
+	}
+	r.StartJob(depth, c.description)
 	for _, s := range c.steps {
 		if s == nil {
 			continue
@@ -258,8 +352,9 @@ func (c combined) run(prefix string) bool {
 				s = s.AssignTo(lvalue)
 			}
 		}
-		ok := s.run(subPrefix + "- ")
+		ok := s.run(r, depth+1)
 		if !ok {
+			r.FinishJob(depth, c.description, Failed)
 			return false
 		}
 	}
@@ -268,13 +363,90 @@ func (c combined) run(prefix string) bool {
 			*lvalue = *c.rvalue
 		}
 	}
+	r.FinishJob(depth, c.description, Succeeded)
+	return true
+}
+
+var skipped = map[string]bool{}
+
+// The descriptions of the steps that were skipped, in order.
+var skippedSteps []string
+
+// The descriptions of the steps that were skipped so far.
+func SkippedSteps() []string {
+	return skippedSteps
+}
+
+// Forget the steps that were skipped so far, such as before upgrading the next of several
+// providers. The steps to skip set by Skip are kept.
+func ResetSkipped() {
+	skippedSteps = nil
+}
+
+// Skip steps and jobs by name instead of running them.
+//
+// The name of a job or a step created by F is its description. The name of a step created
+// by Cmd is the command as written.
+func Skip(names ...string) {
+	for _, name := range names {
+		skipped[name] = true
+	}
+}
+
+// Skipf returns an error that marks the step returning it as skipped instead of failed,
+// for steps that find there is nothing to do. The reason is displayed as the result of the
+// step.
+func Skipf(format string, a ...any) error {
+	return skipError{fmt.Sprintf(format, a...)}
+}
+
+type skipError struct{ reason string }
+
+func (e skipError) Error() string { return "skipped: " + e.reason }
+
+func skip(r Reporter, depth int, description string, assigns bool) bool {
+	msg := "skipped on request"
+	if assigns {
+		msg = colorize.Warn("skipped, but later steps depend on its result")
+	}
+	skippedSteps = append(skippedSteps, description)
+	r.StartStep(depth, description)
+	r.FinishStep(depth, description, Skipped, msg, 0)
 	return true
 }
 
+// Visit each step that running s would run, without running anything.
+func Plan(s Step, visit PlanVisitor) {
+	if s != nil {
+		s.plan(0, nil, visit)
+	}
+}
+
+// A Failure describes the step that caused Run to fail.
+type Failure struct {
+	// The name of the failed step, as passed to Skip.
+	Step string
+	// The error the step failed with.
+	Err error
+	// The standard output of the failed step, if it ran a command.
+	Output string
+}
+
+var lastFailure *Failure
+
+// The step that caused the last call to Run to fail, or nil if it succeeded.
+func LastFailure() *Failure {
+	return lastFailure
+}
+
 // Run a step, returning if the step succeeded.
+//
+// Progress is displayed with the Reporter set by SetReporter. If the step fails,
+// LastFailure describes why.
 func Run(step Step) bool {
+	lastFailure = nil
 	if step == nil {
 		return true
 	}
-	return step.run("")
+	return step.run(reporter, 0)
 }
@@ -0,0 +1,115 @@
+package step
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	trace io.Writer
+	// The directory of the last traced command, so each command doesn't need a cd.
+	traceDir string
+)
+
+// SetTrace writes a shell script that replays each command run by Cmd, and each command
+// passed to Trace, to w. Secrets are redacted from the script.
+//
+// Passing a nil w stops tracing.
+func SetTrace(w io.Writer) {
+	trace, traceDir = w, ""
+	if w != nil {
+		fmt.Fprintln(w, "#!/bin/sh")
+		fmt.Fprintln(w, "set -e")
+	}
+}
+
+// Trace records that command is about to run, if a trace was set by SetTrace.
+//
+// The command is recorded with its working directory, the environment it sets and its
+// full argv.
+func Trace(command *exec.Cmd) {
+	if trace == nil {
+		return
+	}
+	dir, err := filepath.Abs(command.Dir)
+	if err == nil && dir != traceDir {
+		fmt.Fprintf(trace, "\ncd %s\n", shellQuote(dir))
+		traceDir = dir
+	}
+
+	var line []string
+	for _, kv := range addedEnv(command.Env) {
+		k, v, _ := strings.Cut(kv, "=")
+		if secretEnv.MatchString(k) {
+			v = redacted
+		}
+		line = append(line, k+"="+shellQuote(redact(v)))
+	}
+	for _, arg := range command.Args {
+		line = append(line, shellQuote(redact(arg)))
+	}
+	fmt.Fprintln(trace, strings.Join(line, " "))
+}
+
+const redacted = "REDACTED"
+
+var (
+	secretEnv = regexp.MustCompile(`(?i)token|secret|password|passwd|credential|webhook|api_?key`)
+	// GitHub tokens and credentials embedded in URLs.
+	secretValue = regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]+|github_pat_[A-Za-z0-9_]+`)
+	urlUserInfo = regexp.MustCompile(`://[^/@\s]+@`)
+	// The values registered by AddSecretEnv.
+	secrets []string
+)
+
+// AddSecretEnv registers the value of the environment variable key, such as a token loaded
+// from an env file, to be redacted from traces and step logs.
+//
+// Only the values of variables whose names look secret, such as GITHUB_TOKEN, are
+// registered: the values of other variables, such as CGO_ENABLED=0, would redact every
+// occurrence of a common string. Empty values are ignored.
+func AddSecretEnv(key, value string) {
+	if value != "" && secretEnv.MatchString(key) {
+		secrets = append(secrets, value)
+	}
+}
+
+func redact(s string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	s = secretValue.ReplaceAllString(s, redacted)
+	return urlUserInfo.ReplaceAllString(s, "://"+redacted+"@")
+}
+
+// The entries of env that are not already in the environment of the process.
+func addedEnv(env []string) []string {
+	if env == nil {
+		return nil
+	}
+	inherited := map[string]bool{}
+	for _, kv := range os.Environ() {
+		inherited[kv] = true
+	}
+	var added []string
+	for _, kv := range env {
+		if !inherited[kv] {
+			added = append(added, kv)
+		}
+	}
+	return added
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,64 @@
+package upgrade
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed compat-matrix.yaml
+var defaultCompatMatrix []byte
+
+// CompatMatrix maps versions of pulumi-terraform-bridge, or their minor versions, to the
+// version of the pulumi SDK they are known to work with.
+type CompatMatrix map[string]string
+
+// ReadCompatMatrix reads the matrix at path, or the matrix embedded in upgrade-provider if
+// path is empty.
+func ReadCompatMatrix(path string) (CompatMatrix, error) {
+	data, name := defaultCompatMatrix, "compat-matrix.yaml"
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		name = path
+	}
+	return parseCompatMatrix(name, data)
+}
+
+func parseCompatMatrix(name string, data []byte) (CompatMatrix, error) {
+	var entries map[string]string
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	matrix := make(CompatMatrix, len(entries))
+	for bridge, sdk := range entries {
+		v, err := semver.NewVersion(sdk)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", name, bridge, err)
+		}
+		matrix[strings.TrimPrefix(bridge, "v")] = "v" + v.String()
+	}
+	return matrix, nil
+}
+
+// SDKVersion returns the SDK version to pin when the bridge is upgraded to bridgeVersion.
+//
+// An entry for bridgeVersion is preferred over an entry for its minor version.
+func (m CompatMatrix) SDKVersion(bridgeVersion string) (string, bool) {
+	v, err := semver.NewVersion(bridgeVersion)
+	if err != nil {
+		return "", false
+	}
+	if sdk, ok := m[v.String()]; ok {
+		return sdk, true
+	}
+	sdk, ok := m[fmt.Sprintf("%d.%d", v.Major(), v.Minor())]
+	return sdk, ok
+}
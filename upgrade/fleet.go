@@ -0,0 +1,155 @@
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// A provider to upgrade, as listed in a providers file.
+type ProviderEntry struct {
+	Org  string
+	Name string
+	// The name of the upstream provider. Defaults to terraform-provider-{name}, where
+	// {name} is the provider name without "pulumi-".
+	UpstreamProviderName string
+	// The version to upgrade the upstream provider to. If nil, the latest version is used.
+	TargetVersion *semver.Version
+}
+
+type providersFileEntry struct {
+	Name                 string `yaml:"name"`
+	Version              string `yaml:"version"`
+	UpstreamProviderName string `yaml:"upstream-provider-name"`
+}
+
+// An entry may be just the name of the provider.
+func (e *providersFileEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		e.Name = node.Value
+		return nil
+	}
+	type plain providersFileEntry
+	return node.Decode((*plain)(e))
+}
+
+// ReadProvidersFile reads the providers listed in path.
+//
+// The file is either a YAML list, where each entry is a provider or a map with the keys
+// name, version and upstream-provider-name, or a list of providers with one provider per
+// line, optionally followed by a version:
+//
+//	pulumi/pulumi-random
+//	pulumi/pulumi-aws 5.40.0
+//
+// Providers listed without an {org} are in ctx.PulumiOrg.
+//
+// Lines starting with # are ignored.
+func ReadProvidersFile(ctx Context, path string) ([]ProviderEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []providersFileEntry
+	if isYAMLList(data) {
+		if err := yaml.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if len(fields) > 2 {
+				return nil, fmt.Errorf("%s: expected '{org}/{repo} [version]', found '%s'",
+					path, line)
+			}
+			entry := providersFileEntry{Name: fields[0]}
+			if len(fields) == 2 {
+				entry.Version = fields[1]
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	providers := make([]ProviderEntry, len(entries))
+	for i, e := range entries {
+		org, name, found := strings.Cut(e.Name, "/")
+		if !found {
+			org, name = ctx.PulumiOrg, e.Name
+		}
+		if org == "" || !strings.HasPrefix(name, "pulumi-") {
+			return nil, fmt.Errorf("%s: '%s' must be provided as [{org}/]pulumi-{name}", path, e.Name)
+		}
+		p := ProviderEntry{
+			Org:                  org,
+			Name:                 name,
+			UpstreamProviderName: e.UpstreamProviderName,
+		}
+		if p.UpstreamProviderName == "" {
+			p.UpstreamProviderName = "terraform-provider-" + strings.TrimPrefix(name, "pulumi-")
+		}
+		if e.Version != "" {
+			p.TargetVersion, err = ctx.ParseVersion(e.Version)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, e.Name, err)
+			}
+		}
+		providers[i] = p
+	}
+	return providers, nil
+}
+
+// A YAML list has "- " before its first entry.
+func isYAMLList(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return bytes.HasPrefix(line, []byte("- ")) || bytes.Equal(line, []byte("-"))
+	}
+	return false
+}
+
+// UpgradeProviders upgrades each provider in turn, then displays a summary of each
+// upgrade. A failed upgrade doesn't stop the upgrades of the remaining providers.
+func UpgradeProviders(ctx Context, providers []ProviderEntry) error {
+	summaries := make([]string, len(providers))
+	var failed int
+	for i, p := range providers {
+		ctx := ctx
+		ctx.UpstreamProviderName = p.UpstreamProviderName
+		if p.TargetVersion != nil {
+			// A version listed in the providers file takes precedence over --target.
+			ctx.TargetVersion = p.TargetVersion
+			ctx.TargetLatestUpstreamRelease = false
+			ctx.TargetFromBranch = ""
+		}
+
+		summary := &Summary{Repo: p.Org + "/" + p.Name}
+		err := upgradeProvider(ctx, p.Org, p.Name, summary)
+		publishSummary(ctx, *summary, err)
+		if err != nil {
+			failed++
+		}
+		summaries[i] = summary.Format(ctx.ReportFormat, err)
+	}
+
+	fmt.Println()
+	if ctx.ReportFormat == "json" {
+		fmt.Printf("[\n%s\n]\n", strings.Join(summaries, ",\n"))
+	} else {
+		fmt.Println(strings.Join(summaries, "\n\n"))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d provider upgrades failed", failed, len(providers))
+	}
+	return nil
+}
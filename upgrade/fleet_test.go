@@ -0,0 +1,76 @@
+package upgrade
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+func TestReadProvidersFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"lines", `# Providers to upgrade
+pulumi-random
+pulumi/pulumi-aws 5.40.0
+`},
+		{"yaml", `# Providers to upgrade
+- pulumi/pulumi-random
+- name: pulumi/pulumi-aws
+  version: 5.40.0
+`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "providers")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.contents), 0600))
+
+			providers, err := ReadProvidersFile(Context{PulumiOrg: "pulumi"}, path)
+			assert.NoError(t, err)
+			assert.Equal(t, []ProviderEntry{
+				{
+					Org:                  "pulumi",
+					Name:                 "pulumi-random",
+					UpstreamProviderName: "terraform-provider-random",
+				},
+				{
+					Org:                  "pulumi",
+					Name:                 "pulumi-aws",
+					UpstreamProviderName: "terraform-provider-aws",
+					TargetVersion:        semver.MustParse("5.40.0"),
+				},
+			}, providers)
+		})
+	}
+}
+
+func TestUpgradeProvidersResetsSkippedSteps(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+	// Without gh on PATH, each upgrade fails once its environment is set up.
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("GOWORK", "")
+	t.Setenv("PULUMI_MISSING_DOCS_ERROR", "")
+	t.Setenv("PULUMI_CONVERT_EXAMPLES_CACHE_DIR", "")
+	step.Skip(`PULUMI_CONVERT_EXAMPLES_CACHE_DIR=""`)
+
+	ctx := Context{Context: context.Background()}
+	err := UpgradeProviders(ctx, []ProviderEntry{
+		{Org: "pulumi", Name: "pulumi-random", UpstreamProviderName: "terraform-provider-random"},
+		{Org: "pulumi", Name: "pulumi-aws", UpstreamProviderName: "terraform-provider-aws"},
+	})
+	assert.ErrorContains(t, err, "2 of 2 provider upgrades failed")
+
+	// The step was skipped by both upgrades, but the second only has its own skip to do.
+	assert.Equal(t, []string{
+		"Perform the skipped step `PULUMI_CONVERT_EXAMPLES_CACHE_DIR=\"\"`.",
+	}, followUps(ctx))
+}
@@ -0,0 +1,39 @@
+package upgrade
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Create a git repo on the branch main in a temporary directory.
+func newTestRepo(t *testing.T) string {
+	dir := t.TempDir()
+	runGit(t, dir, nil, "init", "--quiet")
+	runGit(t, dir, nil, "checkout", "--quiet", "-b", "main")
+	return dir
+}
+
+// Run git in dir as a test user, with env added to its environment, and return its output.
+// A failure of git fails the test.
+func runGit(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+	out, err := tryGit(dir, env, args...)
+	assert.NoError(t, err, out)
+	return out
+}
+
+// Like runGit, for git commands that are expected to fail.
+func tryGit(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{
+		"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
@@ -3,11 +3,14 @@ package upgrade
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 )
 
 type RepoKind string
@@ -19,6 +22,8 @@ const (
 	ForkedAndShimmed  RepoKind = "forked & shimmed"
 	Patched           RepoKind = "patched"
 	PatchedAndShimmed RepoKind = "patched & shimmed"
+	// The upstream is a git submodule, and is not referenced as a go module.
+	Submodule RepoKind = "submodule"
 )
 
 func (rk RepoKind) Shimmed() RepoKind {
@@ -78,6 +83,155 @@ func (rk RepoKind) IsPatched() bool {
 	}
 }
 
+// The replaces in file that point to a version of a repo hosted by the pulumi org, such as
+// a fork of one of the upstream's dependencies.
+func pulumiForkReplaces(file *modfile.File) []*modfile.Replace {
+	var forks []*modfile.Replace
+	for _, replace := range file.Replace {
+		// Local replaces don't have a version to bump.
+		if replace.New.Version == "" {
+			continue
+		}
+		if org, _, err := providerRepoFromModulePath(replace.New.Path); err == nil && org == "pulumi" {
+			forks = append(forks, replace)
+		}
+	}
+	return forks
+}
+
+// The branch of the pulumi fork replacing replace.Old that tracks the version of
+// replace.Old required by file, such as upstream-v1.2.3. Forks of dependencies follow the
+// upstream-v{version} convention of the forks of upstream providers.
+func transitiveForkBranch(file *modfile.File, replace *modfile.Replace) (string, error) {
+	version := replace.Old.Version
+	if version == "" {
+		for _, r := range file.Require {
+			if r.Mod.Path == replace.Old.Path {
+				version = r.Mod.Version
+			}
+		}
+	}
+	if version == "" {
+		return "", fmt.Errorf("%s is replaced but not required", replace.Old.Path)
+	}
+	return "upstream-v" + strings.TrimPrefix(version, "v"), nil
+}
+
+// Check if replace, a replace of the upstream provider, points to the pulumi fork of the
+// upstream repo tfProviderRepoName.
+//
+// Any module in the fork's repo is recognized, such as github.com/pulumi/{repo}/v2 or the
+// nested module github.com/pulumi/{repo}/sdk/v2. A replace that points to a different pulumi
+// repo, or to neither the upstream nor a pulumi repo, is an error. A replace that points to
+// the upstream repo hosted elsewhere, or to ../upstream for patched providers, is not a
+// fork.
+func isPulumiFork(replace *modfile.Replace, tfProviderRepoName string) (bool, error) {
+	if replace.New.Path == "../upstream" {
+		return false, nil
+	}
+	incorrect := fmt.Errorf("go.mod: replace has incorrect repo: '%s'", replace.New.Path)
+	org, repo, err := providerRepoFromModulePath(replace.New.Path)
+	if err == nil && org == "pulumi" {
+		if repo != tfProviderRepoName {
+			return false, incorrect
+		}
+		return true, nil
+	}
+	// We have a replace directive for upstream, but it doesn't point to a pulumi fork.
+	// For the purposes of this tool, this is not a *forked* provider.
+	for _, elem := range strings.Split(replace.New.Path, "/")[1:] {
+		if elem == tfProviderRepoName {
+			return false, nil
+		}
+	}
+	return false, incorrect
+}
+
+// Infer the {org} and {repo} of the provider checked out at or above dir, from the module
+// path declared in provider/go.mod.
+func InferProviderRepo(dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		file := filepath.Join(dir, "provider", "go.mod")
+		data, err := os.ReadFile(file)
+		if err == nil {
+			path := modfile.ModulePath(data)
+			if path == "" {
+				return "", "", fmt.Errorf("%s: no module path", file)
+			}
+			return providerRepoFromModulePath(path)
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", fmt.Errorf("no provider/go.mod found")
+		}
+		dir = parent
+	}
+}
+
+// Split a provider module path, such as github.com/pulumi/pulumi-foo/provider/v5, into
+// its {org} and {repo}.
+func providerRepoFromModulePath(path string) (string, string, error) {
+	tok := strings.Split(path, "/")
+	if len(tok) < 3 || tok[0] != "github.com" {
+		return "", "", fmt.Errorf("module path '%s' is not hosted on github.com", path)
+	}
+	return tok[1], tok[2], nil
+}
+
+// Find the submodule of the repo at root that references the upstream provider name.
+//
+// The path of the submodule and the module path of the upstream (such as
+// github.com/org/terraform-provider-name) are returned.
+func findUpstreamSubmodule(ctx Context, root, name string) (string, string, bool, error) {
+	if _, err := os.Stat(filepath.Join(root, ".gitmodules")); os.IsNotExist(err) {
+		return "", "", false, nil
+	} else if err != nil {
+		return "", "", false, err
+	}
+	gitModules := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"config", "--file", ".gitmodules"}, args...)...)
+		cmd.Dir = root
+		out, err := traced(cmd).Output()
+		return string(out), err
+	}
+	urls, err := gitModules("--get-regexp", `^submodule\..*\.url$`)
+	if err != nil {
+		return "", "", false, err
+	}
+	for _, line := range strings.Split(urls, "\n") {
+		key, url, found := strings.Cut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		modPath := submoduleModulePath(url)
+		if !strings.HasSuffix(modPath, "/"+name) {
+			continue
+		}
+		subPath, err := gitModules("--get", strings.TrimSuffix(key, ".url")+".path")
+		if err != nil {
+			return "", "", false, err
+		}
+		return strings.TrimSpace(subPath), modPath, true, nil
+	}
+	return "", "", false, nil
+}
+
+// Convert a git remote URL, such as https://github.com/org/repo.git or
+// git@github.com:org/repo.git, into a go module style path: github.com/org/repo.
+func submoduleModulePath(url string) string {
+	url = strings.TrimSuffix(url, ".git")
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git@"} {
+		url = strings.TrimPrefix(url, prefix)
+	}
+	return strings.Replace(url, ":", "/", 1)
+}
+
 func GetRepoKind(ctx Context, repo ProviderRepo) (*GoMod, error) {
 	path := repo.root
 	file := filepath.Join(path, "provider", "go.mod")
@@ -102,18 +256,28 @@ func GetRepoKind(ctx Context, repo ProviderRepo) (*GoMod, error) {
 
 	tfProviderRepoName := ctx.UpstreamProviderName
 
-	getUpstream := func(file *modfile.File) (*modfile.Require, error) {
+	// `go get` doesn't update vendored dependencies, so we need to know to re-vendor.
+	var vendored bool
+	if info, err := os.Stat(filepath.Join(path, "provider", "vendor")); err == nil {
+		vendored = info.IsDir()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	getUpstream := func(file *modfile.File, name string) (*modfile.Require, error) {
 		// Find the name of our upstream dependency
 		for _, mod := range file.Require {
 			pathWithoutVersion := modPathWithoutVersion(mod.Mod.Path)
-			if strings.HasSuffix(pathWithoutVersion, tfProviderRepoName) {
+			if strings.HasSuffix(pathWithoutVersion, name) {
 				return mod, nil
 			}
 		}
-		return nil, fmt.Errorf("could not find upstream '%s' in go.mod", tfProviderRepoName)
+		return nil, fmt.Errorf("could not find upstream '%s' in go.mod", name)
 	}
 
 	var upstream *modfile.Require
+	// The go.mod file that references the upstream provider.
+	upstreamFile := goMod
 	var patched bool
 	patchDir := filepath.Join(path, "upstream")
 	if _, err := os.Stat(patchDir); err == nil {
@@ -136,21 +300,54 @@ func GetRepoKind(ctx Context, repo ProviderRepo) (*GoMod, error) {
 		if err != nil {
 			return nil, fmt.Errorf("shim/go.mod: %w", err)
 		}
-		upstream, err = getUpstream(shimMod)
+		upstream, err = getUpstream(shimMod, tfProviderRepoName)
 		if err != nil {
 			return nil, fmt.Errorf("shim/go.mod: %w", err)
 		}
+		upstreamFile = shimMod
 	} else if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("unexpected error reading '%s': %w", shimDir, err)
 	} else {
-		upstream, err = getUpstream(goMod)
+		upstream, err = getUpstream(goMod, tfProviderRepoName)
 		if err != nil {
-			return nil, fmt.Errorf("go.mod: %w", err)
+			// The upstream might be a submodule instead of a go module.
+			subPath, modPath, found, subErr := findUpstreamSubmodule(ctx, path, tfProviderRepoName)
+			if subErr != nil {
+				return nil, fmt.Errorf(".gitmodules: %w", subErr)
+			}
+			if !found {
+				return nil, fmt.Errorf("go.mod: %w", err)
+			}
+			tok := strings.Split(modPath, "/")
+			return &GoMod{
+				Kind:                Submodule,
+				Upstream:            module.Version{Path: modPath},
+				Submodule:           subPath,
+				Bridge:              bridge,
+				UpstreamProviderOrg: tok[len(tok)-2],
+				Vendored:            vendored,
+			}, nil
 		}
 	}
 
 	contract.Assertf(upstream != nil, "upstream cannot be nil")
 
+	// An upstream that is only required indirectly is misconfigured: `go mod tidy` may
+	// drop or revert the upgraded version.
+	if upstream.Indirect && ctx.Strict {
+		return nil, fmt.Errorf("go.mod: upstream '%s' is only required indirectly", upstream.Mod.Path)
+	}
+
+	// Composite providers bridge more than one upstream provider.
+	var additionalUpstreams []module.Version
+	for _, name := range sortedKeys(ctx.AdditionalUpstreams) {
+		additional, err := getUpstream(upstreamFile, name)
+		if err != nil {
+			return nil, fmt.Errorf("--upstream: %w", err)
+		}
+		additionalUpstreams = append(additionalUpstreams, additional.Mod)
+	}
+
 	// If we find a replace that points to a pulumi hosted repo, that indicates a fork.
 	var fork *modfile.Replace
 	for _, replace := range goMod.Replace {
@@ -158,35 +355,37 @@ func GetRepoKind(ctx Context, repo ProviderRepo) (*GoMod, error) {
 		if replace.Old.Path != upstream.Mod.Path {
 			continue
 		}
-		before, after, found := strings.Cut(replace.New.Path, "/"+tfProviderRepoName)
-		if !found || (after != "" && !versionSuffix.MatchString(after)) {
-			if replace.New.Path == "../upstream" {
-				// We have found a patched provider, so we can just exit here.
-				break
-			}
-			return nil, fmt.Errorf("go.mod: replace has incorrect repo: '%s'", replace.New.Path)
+		isFork, err := isPulumiFork(replace, tfProviderRepoName)
+		if err != nil {
+			return nil, err
 		}
-		repoOrgSeperator := strings.LastIndexByte(before, '/')
-		org := before[repoOrgSeperator+1:]
-		if org != "pulumi" {
-			// We have a replace directive for upstream, but it doesn't point
-			// to a pulumi fork. For the purposes of this tool, this is not a
-			// *forked* provider.
-			break
+		if isFork {
+			fork = replace
 		}
-		fork = replace
 		break
 	}
 
 	out := GoMod{
-		Upstream: upstream.Mod,
-		Fork:     fork,
-		Bridge:   bridge,
+		Upstream:            upstream.Mod,
+		AdditionalUpstreams: additionalUpstreams,
+		Fork:                fork,
+		Bridge:              bridge,
+		Vendored:            vendored,
+		UpstreamIndirect:    upstream.Indirect,
 	}
+	out.TargetDirective = targetDirective(upstream)
 	// get the org name that hosts the upstream repo
 	tok := strings.Split(modPathWithoutVersion(upstream.Mod.Path), "/")
 	out.UpstreamProviderOrg = tok[len(tok)-2]
 
+	// An upstream that tracks an untagged commit is referenced with a pseudo-version.
+	if module.IsPseudoVersion(upstream.Mod.Version) {
+		out.UpstreamCommit, err = module.PseudoVersionRev(upstream.Mod.Version)
+		if err != nil {
+			return nil, fmt.Errorf("upstream pseudo-version '%s': %w", upstream.Mod.Version, err)
+		}
+	}
+
 	if fork == nil {
 		out.Kind = Plain
 	} else {
@@ -202,3 +401,20 @@ func GetRepoKind(ctx Context, repo ProviderRepo) (*GoMod, error) {
 
 	return &out, nil
 }
+
+var upgradeTargetComment = regexp.MustCompile(`(?i)^//\s*upgrade-target\s*:\s*(\S*)`)
+
+// The version in an `// upgrade-target: v5.3.0` comment on the upstream require, or on
+// the line before it. The version is empty if there is no such comment, and is only
+// parsed when it is used as the target.
+func targetDirective(upstream *modfile.Require) string {
+	if upstream.Syntax == nil {
+		return ""
+	}
+	for _, c := range append(upstream.Syntax.Before, upstream.Syntax.Suffix...) {
+		if m := upgradeTargetComment.FindStringSubmatch(strings.TrimSpace(c.Token)); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
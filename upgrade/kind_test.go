@@ -0,0 +1,148 @@
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+func TestProviderRepoFromModulePath(t *testing.T) {
+	tests := []struct{ path, org, repo string }{
+		{"github.com/pulumi/pulumi-random/provider/v4", "pulumi", "pulumi-random"},
+		{"github.com/pulumiverse/pulumi-foo/provider", "pulumiverse", "pulumi-foo"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			org, repo, err := providerRepoFromModulePath(tt.path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.org, org)
+			assert.Equal(t, tt.repo, repo)
+		})
+	}
+
+	_, _, err := providerRepoFromModulePath("gitlab.com/foo/pulumi-foo/provider")
+	assert.Error(t, err)
+}
+
+func TestSubmoduleModulePath(t *testing.T) {
+	for _, url := range []string{
+		"https://github.com/hashicorp/terraform-provider-random.git",
+		"https://github.com/hashicorp/terraform-provider-random",
+		"git@github.com:hashicorp/terraform-provider-random.git",
+	} {
+		assert.Equal(t, "github.com/hashicorp/terraform-provider-random", submoduleModulePath(url))
+	}
+}
+
+func TestPulumiForkReplaces(t *testing.T) {
+	file, err := modfile.Parse("go.mod", []byte(`module github.com/pulumi/terraform-provider-foo
+
+replace (
+	github.com/hashicorp/terraform-plugin-sdk/v2 => github.com/pulumi/terraform-plugin-sdk/v2 v2.0.0-20230710100801-03a71d0fca3d
+	github.com/hashicorp/go-getter => github.com/hashicorp/go-getter v1.7.0
+	github.com/foo/bar => ../bar
+)
+`), nil)
+	assert.NoError(t, err)
+
+	forks := pulumiForkReplaces(file)
+	if assert.Len(t, forks, 1) {
+		assert.Equal(t, "github.com/hashicorp/terraform-plugin-sdk/v2", forks[0].Old.Path)
+	}
+}
+
+func TestTransitiveForkBranch(t *testing.T) {
+	file, err := modfile.Parse("go.mod", []byte(`module github.com/pulumi/terraform-provider-foo
+
+require github.com/hashicorp/terraform-plugin-sdk/v2 v2.26.1
+
+replace (
+	github.com/hashicorp/terraform-plugin-sdk/v2 => github.com/pulumi/terraform-plugin-sdk/v2 v2.0.0-20230710100801-03a71d0fca3d
+	github.com/hashicorp/go-getter v1.7.0 => github.com/pulumi/go-getter v1.7.1-0.20230710100801-03a71d0fca3d
+	github.com/hashicorp/go-cty => github.com/pulumi/go-cty v0.0.0-20230710100801-03a71d0fca3d
+)
+`), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	branch, err := transitiveForkBranch(file, file.Replace[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream-v2.26.1", branch)
+
+	// A replace of a specific version tracks that version.
+	branch, err = transitiveForkBranch(file, file.Replace[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream-v1.7.0", branch)
+
+	_, err = transitiveForkBranch(file, file.Replace[2])
+	assert.ErrorContains(t, err, "github.com/hashicorp/go-cty is replaced but not required")
+}
+
+func TestIsPulumiFork(t *testing.T) {
+	const name = "terraform-provider-aws"
+	tests := []struct {
+		path    string
+		isFork  bool
+		invalid bool
+	}{
+		{path: "github.com/pulumi/terraform-provider-aws", isFork: true},
+		{path: "github.com/pulumi/terraform-provider-aws/v5", isFork: true},
+		// A nested module of the fork.
+		{path: "github.com/pulumi/terraform-provider-aws/internal/provider", isFork: true},
+		{path: "github.com/pulumi/terraform-provider-aws/sdk/v2", isFork: true},
+		// A patched provider.
+		{path: "../upstream"},
+		// The upstream, hosted somewhere other than the pulumi org.
+		{path: "github.com/someone/terraform-provider-aws/v5"},
+		{path: "gitlab.com/someone/terraform-provider-aws"},
+		// A different pulumi repo.
+		{path: "github.com/pulumi/terraform-provider-aws-extra", invalid: true},
+		{path: "github.com/pulumi/terraform-provider-azure", invalid: true},
+		{path: "github.com/someone/unrelated", invalid: true},
+		{path: "../somewhere", invalid: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			isFork, err := isPulumiFork(&modfile.Replace{
+				Old: module.Version{Path: "github.com/hashicorp/terraform-provider-aws"},
+				New: module.Version{Path: tt.path},
+			}, name)
+			if tt.invalid {
+				assert.ErrorContains(t, err, "replace has incorrect repo")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.isFork, isFork)
+		})
+	}
+}
+
+func TestTargetDirective(t *testing.T) {
+	data := []byte(`module github.com/pulumi/pulumi-aws/provider/v6
+
+go 1.21
+
+require (
+	github.com/hashicorp/terraform-provider-aws v1.60.1-0.20240101000000-abcdef123456 // upgrade-target: v5.3.0
+	// Upgrade-Target:v4.2.0
+	github.com/hashicorp/terraform-provider-google v1.1.0
+	github.com/hashicorp/terraform-provider-azurerm v1.2.0 // indirect
+	github.com/pulumi/pulumi-terraform-bridge/v3 v3.80.0 // upgrade-target:
+)
+`)
+	file, err := modfile.Parse("go.mod", data, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var directives []string
+	for _, r := range file.Require {
+		directives = append(directives, targetDirective(r))
+	}
+	assert.Equal(t, []string{"v5.3.0", "v4.2.0", "", ""}, directives)
+}
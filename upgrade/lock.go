@@ -0,0 +1,89 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long lockCheckout waits for another run to release a checkout, unless the context
+// has an earlier deadline.
+const lockCheckoutWait = 30 * time.Minute
+
+// The error of tryLock when another process holds the lock.
+type lockedError struct {
+	file string
+	// The pid of the process holding the lock, if it was recorded.
+	holder string
+}
+
+func (e *lockedError) Error() string {
+	holder := e.holder
+	if holder == "" {
+		holder = "unknown"
+	}
+	return fmt.Sprintf("%s is held by pid %s", e.file, holder)
+}
+
+// The error of lockFile when the file is already locked.
+var errLockHeld = errors.New("lock held")
+
+// Take the lock held on lockFile without waiting. The returned function releases the lock.
+//
+// The lock is held by the OS on the open file, so it is released when the process exits,
+// even if the process is killed. A lock file left behind by such a process is not held.
+// The pid of the process holding the lock is recorded in lockFile.
+//
+// If another process holds the lock, the error is a *lockedError.
+func tryLock(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLockHeld) {
+			holder, _ := os.ReadFile(path)
+			return nil, &lockedError{file: path, holder: strings.TrimSpace(string(holder))}
+		}
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt(pid, 0)
+	}
+	return func() {
+		_ = f.Truncate(0)
+		_ = unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Lock the checkout at path against concurrent runs of upgrade-provider, waiting until the
+// lock is available for at most wait. The returned function releases the lock.
+//
+// The lock is a file next to the checkout, so it works across processes.
+func lockCheckout(ctx context.Context, path string, wait time.Duration) (func(), error) {
+	lockFile := path + ".lock"
+	timeout := time.After(wait)
+	for {
+		unlock, err := tryLock(lockFile)
+		var locked *lockedError
+		if !errors.As(err, &locked) {
+			return unlock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for another upgrade using %s: %s: %w",
+				path, locked, ctx.Err())
+		case <-timeout:
+			return nil, fmt.Errorf("waited %s for another upgrade using %s: %s",
+				wait, path, locked)
+		case <-time.After(time.Second):
+		}
+	}
+}
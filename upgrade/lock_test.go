@@ -0,0 +1,36 @@
+package upgrade
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockCheckout(t *testing.T) {
+	ctx := context.Background()
+	checkout := filepath.Join(t.TempDir(), "terraform-provider-foo")
+
+	// A lock file left behind by a killed run is not held.
+	assert.NoError(t, os.WriteFile(checkout+".lock", []byte("99999999\n"), 0600))
+	unlock, err := lockCheckout(ctx, checkout, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := os.ReadFile(checkout + ".lock")
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(data))
+
+	// The wait for a held lock is bounded, and names the holder.
+	_, err = lockCheckout(ctx, checkout, 10*time.Millisecond)
+	assert.ErrorContains(t, err, "held by pid "+strconv.Itoa(os.Getpid()))
+
+	unlock()
+	unlock, err = lockCheckout(ctx, checkout, time.Minute)
+	assert.NoError(t, err)
+	unlock()
+}
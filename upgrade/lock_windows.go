@@ -0,0 +1,27 @@
+package upgrade
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows locks are mandatory, so we lock a byte past the pid recorded in the file to keep
+// it readable.
+var lockRegion = windows.Overlapped{OffsetHigh: 1}
+
+func lockFile(f *os.File) error {
+	ol := lockRegion
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errLockHeld
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	ol := lockRegion
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
@@ -0,0 +1,115 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+// A Plan records the decisions made by discovering a repository, so that an upgrade can be
+// reviewed before it is applied.
+//
+// Applying a plan still sets up the repository, but the versions to upgrade to are taken
+// from the plan instead of being discovered again.
+type Plan struct {
+	// The provider repo, as {org}/{repo}.
+	Repo string   `json:"repo"`
+	Kind RepoKind `json:"kind"`
+
+	UpstreamFrom string `json:"upstreamFrom,omitempty"`
+	UpstreamTo   string `json:"upstreamTo,omitempty"`
+	// The upstream commit to pin, if any.
+	UpstreamSHA string `json:"upstreamSHA,omitempty"`
+	// The upgrade issues that the upgrade closes.
+	GHIssues []UpgradeTargetIssue `json:"issues,omitempty"`
+
+	BridgeFrom string `json:"bridgeFrom,omitempty"`
+	BridgeTo   string `json:"bridgeTo,omitempty"`
+
+	// The working branch the upgrade is made on.
+	Branch string `json:"branch"`
+	// The steps that applying the plan runs, in order.
+	Steps []PlannedStep `json:"steps"`
+}
+
+// A step that would run, as visited by step.Plan.
+type PlannedStep struct {
+	Depth int    `json:"depth"`
+	Name  string `json:"name"`
+	Dir   string `json:"dir,omitempty"`
+}
+
+// WritePlan discovers the repository and writes the Plan of its upgrade to path, without
+// upgrading anything.
+func WritePlan(ctx Context, repoOrg, repoName, path string) error {
+	ctx.PlanFile = path
+	return upgradeProvider(ctx, repoOrg, repoName, &Summary{Repo: repoOrg + "/" + repoName})
+}
+
+// Apply a Plan written by WritePlan: upgrade to the planned versions instead of discovering
+// them.
+func (p *Plan) Apply(ctx Context) Context {
+	ctx.AppliedPlan = p
+	ctx.InferVersion = false
+	ctx.TargetFromUpstreamCheckout = ""
+	ctx.TargetBranchTip = ""
+	ctx.TargetLatestUpstreamRelease = false
+	ctx.TargetFromBranch = ""
+	ctx.TargetVersion = nil
+	ctx.UpgradeProviderVersion = p.UpstreamTo != ""
+	if ctx.UpgradeProviderVersion {
+		// ReadPlan validated the version.
+		ctx.TargetVersion = semver.MustParse(p.UpstreamTo)
+	}
+	ctx.UpgradeBridgeVersion = p.BridgeTo != ""
+	return ctx
+}
+
+func ReadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if plan.UpstreamTo != "" {
+		if _, err := semver.NewVersion(plan.UpstreamTo); err != nil {
+			return nil, fmt.Errorf("%s: upstreamTo: %w", path, err)
+		}
+	}
+	return &plan, nil
+}
+
+func (p Plan) write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// Record the steps that running s would run.
+func (p *Plan) addSteps(s step.Step) {
+	step.Plan(s, func(depth int, name, dir string) {
+		p.Steps = append(p.Steps, PlannedStep{Depth: depth, Name: name, Dir: dir})
+	})
+}
+
+// Display the planned steps, and the directories they would run in.
+func (p Plan) printSteps() {
+	for _, s := range p.Steps {
+		line := strings.Repeat("  ", s.Depth) + s.Name
+		if s.Dir != "" {
+			line += colorize.Bold(" (in " + s.Dir + ")")
+		}
+		fmt.Println(colorize.Display(line))
+	}
+}
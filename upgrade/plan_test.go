@@ -0,0 +1,32 @@
+package upgrade
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	plan := Plan{
+		Repo:       "pulumi/pulumi-random",
+		Kind:       Plain,
+		UpstreamTo: "3.5.1",
+		GHIssues:   []UpgradeTargetIssue{{Number: 42}},
+		BridgeTo:   "v3.41.0",
+		Branch:     "upgrade-terraform-provider-random-to-v3.5.1",
+		Steps:      []PlannedStep{{Depth: 0, Name: "Update Artifacts"}},
+	}
+	assert.NoError(t, plan.write(path))
+
+	read, err := ReadPlan(path)
+	assert.NoError(t, err)
+	assert.Equal(t, plan, *read)
+
+	ctx := read.Apply(Context{InferVersion: true})
+	assert.False(t, ctx.InferVersion)
+	assert.True(t, ctx.UpgradeProviderVersion)
+	assert.True(t, ctx.UpgradeBridgeVersion)
+	assert.Equal(t, "3.5.1", ctx.TargetVersion.String())
+}
@@ -0,0 +1,49 @@
+package upgrade
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+// RebuildSDKs regenerates the SDKs on an existing upgrade branch, without upgrading
+// anything else. The regenerated SDKs are committed and pushed to the branch.
+//
+// This is useful when `make build_sdks` produced a bad artifact and the fix does not
+// require redoing the rest of the upgrade.
+func RebuildSDKs(ctx Context, repoOrg, repoName, branch string) error {
+	repo := ProviderRepo{
+		name:          repoName,
+		org:           repoOrg,
+		workingBranch: branch,
+	}
+
+	ok := step.Run(step.Combined("Rebuilding SDKs",
+		OrgProviderRepos(ctx, repoOrg, repoName).AssignTo(&repo.root),
+		step.F("Branch exists", func() (string, error) {
+			_, err := runGitCommand[any](ctx, nil,
+				"rev-parse", "--verify", "--quiet", "refs/heads/"+branch)
+			if err == nil {
+				return "yes", nil
+			}
+			// The branch may have been pushed from another checkout.
+			_, err = runGitCommand[any](ctx, nil, "fetch", "origin", branch+":"+branch)
+			if err != nil {
+				return "", fmt.Errorf("branch '%s' does not exist locally or on origin", branch)
+			}
+			return "fetched from origin", nil
+		}).In(&repo.root),
+		EnsureBranchCheckedOut(ctx, branch, "").In(&repo.root),
+		// repo.root is only known once the repo is checked out.
+		step.Computed(func() step.Step { return BuildSDKs(ctx, repo) }),
+		step.Cmd(exec.CommandContext(ctx, "git", "add", "--all")).In(&repo.root),
+		GitCommit(ctx, ctx.commitMessage("make build_sdks", "sdk", "regenerate SDKs"),
+			"").In(&repo.root),
+		step.Cmd(exec.CommandContext(ctx, "git", "push", "origin", branch)).In(&repo.root),
+	))
+	if !ok {
+		return handledError()
+	}
+	return nil
+}
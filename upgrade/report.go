@@ -0,0 +1,184 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Masterminds/semver/v3"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+// ReportVersions displays the upstream version pinned by the provider and the latest
+// available upstream version, without performing any upgrade.
+//
+// The report is a CSV row, preceded by a header:
+//
+//	repo,kind,current,latest,delta
+//
+// delta describes the distance between current and latest, such as 0.2.0 for two minor
+// versions, so that reports can be sorted with `sort -t, -k5 -V`.
+func ReportVersions(ctx Context, repoOrg, repoName string) error {
+	repo := ProviderRepo{
+		name: repoName,
+		org:  repoOrg,
+	}
+	var goMod *GoMod
+	var target *UpstreamUpgradeTarget
+
+	ok := step.Run(step.Combined("Discovering Repository",
+		OrgProviderRepos(ctx, repoOrg, repoName).AssignTo(&repo.root),
+		PullDefaultBranch(ctx, "origin").In(&repo.root).
+			AssignTo(&repo.defaultBranch),
+		step.F("Repo kind", func() (string, error) {
+			var err error
+			goMod, err = GetRepoKind(ctx, repo)
+			if err != nil {
+				return "", err
+			}
+			return string(goMod.Kind), nil
+		}),
+		step.F("Current Upstream Version", func() (string, error) {
+			if err := setCurrentUpstream(ctx, &repo, goMod); err != nil {
+				return "", err
+			}
+			return repo.currentUpstreamVersion.String(), nil
+		}),
+		step.F("Latest Upstream Version", func() (string, error) {
+			var msg string
+			var err error
+			target, msg, err = GetExpectedTarget(ctx, repoOrg+"/"+repoName, goMod)
+			if err != nil {
+				return "", err
+			}
+			if target == nil || target.Version == nil {
+				return "none found" + msg, nil
+			}
+			return target.Version.String() + msg, nil
+		}),
+	))
+	if !ok {
+		return handledError()
+	}
+
+	latest := repo.currentUpstreamVersion
+	if target != nil && target.Version != nil {
+		latest = target.Version
+	}
+	fmt.Println("repo,kind,current,latest,delta")
+	fmt.Printf("%s/%s,%s,%s,%s,%s\n", repoOrg, repoName, goMod.Kind,
+		repo.currentUpstreamVersion, latest, versionDelta(repo.currentUpstreamVersion, latest))
+	return nil
+}
+
+// EmitGoModJSON discovers the provider repo, then prints the analysis of its go.mod as
+// JSON, without performing any upgrade.
+func EmitGoModJSON(ctx Context, repoOrg, repoName string) error {
+	repo := ProviderRepo{
+		name: repoName,
+		org:  repoOrg,
+	}
+	var goMod *GoMod
+
+	ok := step.Run(step.Combined("Discovering Repository",
+		OrgProviderRepos(ctx, repoOrg, repoName).AssignTo(&repo.root),
+		PullDefaultBranch(ctx, "origin").In(&repo.root).
+			AssignTo(&repo.defaultBranch),
+		step.F("Repo kind", func() (string, error) {
+			var err error
+			goMod, err = GetRepoKind(ctx, repo)
+			if err != nil {
+				return "", err
+			}
+			return string(goMod.Kind), nil
+		}),
+	))
+	if !ok {
+		return handledError()
+	}
+
+	data, err := json.MarshalIndent(goMod, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// The distance between two versions, as a version. Only the most significant differing
+// component is reported: 1.2.3 to 2.0.1 has a delta of 1.0.0.
+func versionDelta(from, to *semver.Version) string {
+	switch {
+	case !from.LessThan(to):
+		return "0.0.0"
+	case from.Major() != to.Major():
+		return fmt.Sprintf("%d.0.0", to.Major()-from.Major())
+	case from.Minor() != to.Minor():
+		return fmt.Sprintf("0.%d.0", to.Minor()-from.Minor())
+	default:
+		return fmt.Sprintf("0.0.%d", to.Patch()-from.Patch())
+	}
+}
+
+// PrintUpstreamURLs displays the clone URL and the location that the provider repo and
+// its upstream resolve to, without cloning anything.
+//
+// The upstream is only known from provider/go.mod, so it is only displayed when the
+// provider repo is already checked out.
+func PrintUpstreamURLs(ctx Context, repoOrg, repoName string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("could not resolve cwd: %w", err)
+	}
+	// Resolve repoPath the way ensureRepo does.
+	resolve := func(repoPath, cloneURL string) (string, error) {
+		location, err := getRepoExpectedLocation(ctx, cwd, repoPath)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", repoPath, err)
+		}
+		if cloneURL == "" {
+			cloneURL, err = repoCloneURL(ctx, repoPath)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", repoPath, err)
+			}
+		}
+		fmt.Printf("%s\n  clone URL: %s\n  location:  %s\n", colorize.Display(colorize.Bold(repoPath)),
+			cloneURL, location)
+		return location, nil
+	}
+
+	providerPath, err := providerRepoPath(ctx, repoOrg, repoName)
+	if err != nil {
+		return err
+	}
+	root, err := resolve(providerPath, ctx.ProviderRepoURL)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(root, "provider", "go.mod")); os.IsNotExist(err) {
+		fmt.Println(colorize.Display(colorize.Warn("The provider is not checked out, so its upstream is unknown")))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	goMod, err := GetRepoKind(ctx, ProviderRepo{
+		root:          root,
+		name:          repoName,
+		org:           repoOrg,
+		defaultBranch: "HEAD",
+	})
+	if err != nil {
+		return err
+	}
+	// Forked providers clone the upstream that the fork replaces.
+	upstream := goMod.Upstream.Path
+	if goMod.Kind.IsForked() {
+		upstream = goMod.Fork.Old.Path
+	}
+	_, err = resolve(upstreamRepoPath(ctx, upstream), "")
+	return err
+}
@@ -0,0 +1,25 @@
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionDelta(t *testing.T) {
+	tests := []struct{ from, to, expected string }{
+		{"1.2.3", "2.0.1", "1.0.0"},
+		{"1.2.3", "1.4.0", "0.2.0"},
+		{"1.2.3", "1.2.7", "0.0.4"},
+		{"1.2.3", "1.2.3", "0.0.0"},
+		{"1.2.3", "1.2.0", "0.0.0"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			assert.Equal(t, tt.expected,
+				versionDelta(semver.MustParse(tt.from), semver.MustParse(tt.to)))
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// The parts of a Pulumi package schema that breaking changes are detected in.
+type packageSchema struct {
+	Resources map[string]struct {
+		InputProperties map[string]json.RawMessage `json:"inputProperties"`
+		RequiredInputs  []string                   `json:"requiredInputs"`
+		Properties      map[string]json.RawMessage `json:"properties"`
+	} `json:"resources"`
+	Functions map[string]struct {
+		Inputs *struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+			Required   []string                   `json:"required"`
+		} `json:"inputs"`
+	} `json:"functions"`
+	Types map[string]struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	} `json:"types"`
+}
+
+// breakingSchemaChanges lists the changes from the schema before to the schema after that
+// break users of the provider: removed resources, functions, types and properties, and
+// inputs that became required.
+//
+// An empty list means the change is not breaking.
+func breakingSchemaChanges(before, after []byte) ([]string, error) {
+	var old, new packageSchema
+	if err := json.Unmarshal(before, &old); err != nil {
+		return nil, fmt.Errorf("previous schema: %w", err)
+	}
+	if err := json.Unmarshal(after, &new); err != nil {
+		return nil, fmt.Errorf("new schema: %w", err)
+	}
+
+	var changes []string
+	removed := func(kind, parent string, old, new map[string]json.RawMessage) {
+		for name := range old {
+			if _, ok := new[name]; !ok {
+				changes = append(changes, fmt.Sprintf("%s %s.%s was removed", kind, parent, name))
+			}
+		}
+	}
+	nowRequired := func(parent string, old, new []string) {
+		was := map[string]bool{}
+		for _, name := range old {
+			was[name] = true
+		}
+		for _, name := range new {
+			if !was[name] {
+				changes = append(changes, fmt.Sprintf("input %s.%s is now required", parent, name))
+			}
+		}
+	}
+
+	for tok, r := range old.Resources {
+		n, ok := new.Resources[tok]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("resource %s was removed", tok))
+			continue
+		}
+		removed("input", tok, r.InputProperties, n.InputProperties)
+		removed("property", tok, r.Properties, n.Properties)
+		nowRequired(tok, r.RequiredInputs, n.RequiredInputs)
+	}
+	for tok, f := range old.Functions {
+		n, ok := new.Functions[tok]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("function %s was removed", tok))
+			continue
+		}
+		// A function without inputs has no input properties.
+		var oldInputs, newInputs map[string]json.RawMessage
+		var oldRequired, newRequired []string
+		if f.Inputs != nil {
+			oldInputs, oldRequired = f.Inputs.Properties, f.Inputs.Required
+		}
+		if n.Inputs != nil {
+			newInputs, newRequired = n.Inputs.Properties, n.Inputs.Required
+		}
+		removed("input", tok, oldInputs, newInputs)
+		nowRequired(tok, oldRequired, newRequired)
+	}
+	for tok, t := range old.Types {
+		n, ok := new.Types[tok]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("type %s was removed", tok))
+			continue
+		}
+		removed("property", tok, t.Properties, n.Properties)
+	}
+
+	sort.Strings(changes)
+	return changes, nil
+}
@@ -0,0 +1,81 @@
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakingSchemaChanges(t *testing.T) {
+	before := `{
+  "resources": {
+    "foo:index:Bucket": {
+      "inputProperties": {"name": {}, "acl": {}},
+      "properties": {"name": {}, "acl": {}, "arn": {}}
+    },
+    "foo:index:Legacy": {}
+  },
+  "functions": {
+    "foo:index:getBucket": {"inputs": {"properties": {"name": {}}}},
+    "foo:index:getObject": {"inputs": {"properties": {"key": {}}}}
+  },
+  "types": {
+    "foo:index:Rule": {"properties": {"id": {}}}
+  }
+}`
+
+	tests := []struct {
+		name     string
+		after    string
+		expected []string
+	}{
+		{"unchanged", before, nil},
+		{"additions", `{
+  "resources": {
+    "foo:index:Bucket": {
+      "inputProperties": {"name": {}, "acl": {}, "tags": {}},
+      "properties": {"name": {}, "acl": {}, "arn": {}, "tags": {}}
+    },
+    "foo:index:Legacy": {},
+    "foo:index:Object": {}
+  },
+  "functions": {
+    "foo:index:getBucket": {"inputs": {"properties": {"name": {}}}},
+    "foo:index:getObject": {"inputs": {"properties": {"key": {}}}}
+  },
+  "types": {
+    "foo:index:Rule": {"properties": {"id": {}}}
+  }
+}`, nil},
+		{"removals", `{
+  "resources": {
+    "foo:index:Bucket": {
+      "inputProperties": {"name": {}},
+      "requiredInputs": ["name"],
+      "properties": {"name": {}, "arn": {}}
+    }
+  },
+  "functions": {
+    "foo:index:getBucket": {"inputs": {"properties": {"name": {}}, "required": ["name"]}},
+    "foo:index:getObject": {}
+  },
+  "types": {}
+}`, []string{
+			"input foo:index:Bucket.acl was removed",
+			"input foo:index:Bucket.name is now required",
+			"input foo:index:getBucket.name is now required",
+			"input foo:index:getObject.key was removed",
+			"property foo:index:Bucket.acl was removed",
+			"resource foo:index:Legacy was removed",
+			"type foo:index:Rule was removed",
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := breakingSchemaChanges([]byte(before), []byte(tt.after))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, changes)
+		})
+	}
+}
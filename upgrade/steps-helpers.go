@@ -1,21 +1,31 @@
 package upgrade
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+
+	"github.com/pulumi/upgrade-provider/step"
 )
 
 var versionSuffix = regexp.MustCompile("/v[2-9][0-9]*$")
@@ -25,7 +35,7 @@ func runGitCommand[T any](
 ) (result T, err error) {
 	var t T
 
-	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd := traced(exec.CommandContext(ctx, "git", args...))
 	if filter != nil {
 		out := new(bytes.Buffer)
 		cmd.Stdout = out
@@ -45,6 +55,38 @@ func modPathWithoutVersion(path string) string {
 	return path
 }
 
+// The path of the upstream repo, such as github.com/hashicorp/terraform-provider-aws,
+// for the upstream module at modulePath.
+//
+// ctx.UpstreamOwnerRepo wins over the module path.
+func upstreamRepoPath(ctx Context, modulePath string) string {
+	if ctx.UpstreamOwnerRepo != "" {
+		return "github.com/" + ctx.UpstreamOwnerRepo
+	}
+	return modPathWithoutVersion(modulePath)
+}
+
+// The path of the repo of the fork at modulePath. A fork on GitHub can replace the upstream
+// with a module nested in the repo, such as
+// github.com/pulumi/terraform-provider-aws/internal/provider, which is hosted by
+// github.com/pulumi/terraform-provider-aws.
+func forkRepoPath(modulePath string) string {
+	if org, repo, err := providerRepoFromModulePath(modulePath); err == nil {
+		return "github.com/" + org + "/" + repo
+	}
+	return modPathWithoutVersion(modulePath)
+}
+
+// The {owner}/{repo} of the upstream provider on GitHub, given the org of the upstream.
+//
+// ctx.UpstreamOwnerRepo wins over org and ctx.UpstreamProviderName.
+func upstreamOwnerRepo(ctx Context, org string) string {
+	if ctx.UpstreamOwnerRepo != "" {
+		return ctx.UpstreamOwnerRepo
+	}
+	return org + "/" + ctx.UpstreamProviderName
+}
+
 // Find the go module version of needleModule, searching from the default repo branch, not
 // the currently checked out code.
 func originalGoVersionOf(ctx context.Context, repo ProviderRepo, file, needleModule string) (module.Version, bool, error) {
@@ -79,7 +121,7 @@ func originalGoVersionOf(ctx context.Context, repo ProviderRepo, file, needleMod
 func baseFileAt(ctx context.Context, repo ProviderRepo, file string) ([]byte, error) {
 	cmd := exec.CommandContext(ctx, "git", "show", repo.defaultBranch+":"+file)
 	cmd.Dir = repo.root
-	data, err := cmd.Output()
+	data, err := traced(cmd).Output()
 	if err != nil {
 		return nil, fmt.Errorf("%s:%s: %w", repo.defaultBranch, file, err)
 	}
@@ -88,7 +130,7 @@ func baseFileAt(ctx context.Context, repo ProviderRepo, file string) ([]byte, er
 
 func prBody(ctx Context, repo ProviderRepo,
 	upgradeTarget *UpstreamUpgradeTarget, goMod *GoMod,
-	targetBridge, tfSDKUpgrade string) string {
+	targetBridge, tfSDKUpgrade, goModDiff string, todo []string) string {
 	b := new(strings.Builder)
 	fmt.Fprintf(b, "This PR was generated via `$ upgrade-provider %s`.\n",
 		strings.Join(os.Args[1:], " "))
@@ -122,9 +164,91 @@ func prBody(ctx Context, repo ProviderRepo,
 			parts[0], parts[1])
 	}
 
+	if goModDiff != "" {
+		fmt.Fprintf(b, "\n### go.mod changes\n\n```diff\n%s\n```\n", goModDiff)
+	}
+
+	if len(todo) > 0 {
+		fmt.Fprintf(b, "\n### Remaining manual steps\n\n")
+		for _, t := range todo {
+			fmt.Fprintf(b, "- [ ] %s\n", t)
+		}
+	}
+
 	return b.String()
 }
 
+// The diff of the go.mod files referencing the upstream provider since repo.baseSHA, run
+// from the repository root. The diff of provider/shim/go.mod is only included for
+// shimmed providers.
+func goModDiff(ctx Context, repo ProviderRepo, goMod *GoMod) (string, error) {
+	files := []string{filepath.Join("provider", "go.mod")}
+	if goMod.Kind.IsShimmed() {
+		files = append(files, filepath.Join("provider", "shim", "go.mod"))
+	}
+	base := repo.baseSHA
+	if base == "" {
+		base = repo.defaultBranch
+	}
+	return runGitCommand(ctx, func(b []byte) (string, error) {
+		return strings.TrimSpace(string(b)), nil
+	}, append([]string{"diff", base, "--"}, files...)...)
+}
+
+// A one line description of the upgrade, used as the PR title.
+func upgradeTitle(ctx Context, target *UpstreamUpgradeTarget, targetBridgeVersion string) string {
+	if ctx.UpgradeProviderVersion {
+		return fmt.Sprintf("Upgrade %s to v%s",
+			ctx.UpstreamProviderName, target.Version)
+	} else if ctx.UpgradeBridgeVersion {
+		return "Upgrade pulumi-terraform-bridge to " + targetBridgeVersion
+	} else if ctx.UpgradeCodeMigration {
+		return fmt.Sprintf("Code migration: %s", strings.Join(ctx.MigrationOpts, ", "))
+	}
+	panic("Unknown action")
+}
+
+// The manual steps that remain after the automated upgrade.
+func followUps(ctx Context) []string {
+	var todo []string
+	if ctx.MajorVersionBump {
+		todo = append(todo, "Update README.md and sdk/python/README.md for the new major version.")
+	}
+	for _, s := range step.SkippedSteps() {
+		todo = append(todo, fmt.Sprintf("Perform the skipped step `%s`.", s))
+	}
+	return todo
+}
+
+// commitBody describes the version changes made by an upgrade, so that the generated
+// commits are self-documenting in `git log`.
+func commitBody(ctx Context, repo ProviderRepo,
+	upgradeTarget *UpstreamUpgradeTarget, goMod *GoMod, targetBridge string) string {
+	b := new(strings.Builder)
+	if ctx.UpgradeProviderVersion {
+		contract.Assertf(upgradeTarget != nil, "upgradeTarget should always be non-nil")
+		prev := goMod.Upstream.Version
+		if repo.currentUpstreamVersion != nil {
+			prev = "v" + repo.currentUpstreamVersion.String()
+		}
+		fmt.Fprintf(b, "Upgrade %s from %s to v%s",
+			modPathWithoutVersion(goMod.Upstream.Path), prev, upgradeTarget.Version)
+		if upgradeTarget.Branch != "" {
+			fmt.Fprintf(b, " (tip of branch %s at %s)", upgradeTarget.Branch, upgradeTarget.SHA)
+		}
+		b.WriteString("\n")
+	}
+	if ctx.UpgradeBridgeVersion {
+		fmt.Fprintf(b, "Upgrade github.com/pulumi/pulumi-terraform-bridge from %s to %s\n",
+			goMod.Bridge.Version, targetBridge)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Ensure that the upstream repo has a remote named "pulumi" for the pulumi fork.
+//
+// The remote URL is ctx.ForkRemoteURL if set, otherwise it is computed from
+// ctx.UpstreamOwnerRepo or name.
 func ensurePulumiRemote(ctx Context, name string) (string, error) {
 	remotes, err := runGitCommand(ctx, func(b []byte) ([]string, error) {
 		return strings.Split(string(b), "\n"), nil
@@ -133,14 +257,137 @@ func ensurePulumiRemote(ctx Context, name string) (string, error) {
 		return "", fmt.Errorf("listing remotes: %w", err)
 	}
 	for _, remote := range remotes {
-		if remote == "pulumi" {
-			return "'pulumi' already exists", nil
+		if remote != "pulumi" {
+			continue
+		}
+		if ctx.ForkRemoteURL != "" {
+			// An explicit URL wins over whatever the remote was set to before.
+			return runGitCommand(ctx, say("'pulumi' set to "+ctx.ForkRemoteURL),
+				"remote", "set-url", "pulumi", ctx.ForkRemoteURL)
 		}
+		return "'pulumi' already exists", nil
+	}
+	url := ctx.ForkRemoteURL
+	if url == "" && ctx.UpstreamOwnerRepo != "" {
+		url = "https://github.com/pulumi/" + path.Base(ctx.UpstreamOwnerRepo) + ".git"
+	} else if url == "" {
+		url = fmt.Sprintf("https://github.com/pulumi/terraform-provider-%s.git", name)
 	}
 	return runGitCommand(ctx, func([]byte) (string, error) {
 		return "set to 'pulumi'", nil
-	}, "remote", "add", "pulumi",
-		fmt.Sprintf("https://github.com/pulumi/terraform-provider-%s.git", name))
+	}, "remote", "add", "pulumi", url)
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// The SDK languages that providers generate.
+var sdkLanguages = []string{"dotnet", "go", "java", "nodejs", "python"}
+
+// Detect the SDK languages that the provider at root generates, from the directories
+// in sdk/.
+func detectSDKLanguages(root string) ([]string, error) {
+	var found []string
+	for _, lang := range sdkLanguages {
+		info, err := os.Stat(filepath.Join(root, "sdk", lang))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			found = append(found, lang)
+		}
+	}
+	return found, nil
+}
+
+// The name of the branch that upgrades the upstream provider to v, where major is the
+// major version of the provider after the upgrade.
+func providerUpgradeBranch(ctx Context, v *semver.Version, major int64) string {
+	return upgradeBranch(ctx, ctx.UpstreamProviderName, "v"+v.String(), major)
+}
+
+// The name of the branch that upgrades pulumi-terraform-bridge to version.
+func bridgeUpgradeBranch(ctx Context, version string, major int64) string {
+	return upgradeBranch(ctx, "pulumi-terraform-bridge", version, major)
+}
+
+// The placeholders of --branch-template.
+var branchPlaceholders = []string{"{name}", "{version}", "{major}", "{date}"}
+
+// ValidateBranchTemplate checks that template only uses known placeholders.
+func ValidateBranchTemplate(template string) error {
+	r := strings.NewReplacer("{name}", "", "{version}", "", "{major}", "", "{date}", "")
+	if rest := r.Replace(template); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unknown placeholder in '%s': must be one of %s",
+			template, strings.Join(branchPlaceholders, ", "))
+	}
+	return nil
+}
+
+func upgradeBranch(ctx Context, name, version string, major int64) string {
+	if ctx.BranchTemplate == "" {
+		return "upgrade-" + name + "-to-" + version
+	}
+	return strings.NewReplacer(
+		"{name}", name,
+		"{version}", version,
+		"{major}", strconv.FormatInt(major, 10),
+		"{date}", time.Now().Format("2006-01-02"),
+	).Replace(ctx.BranchTemplate)
+}
+
+// A pattern matching the branches named by upgradeBranch for name, at any version.
+func upgradeBranchPattern(ctx Context, name string) *regexp.Regexp {
+	template := ctx.BranchTemplate
+	if template == "" {
+		template = "upgrade-{name}-to-{version}"
+	}
+	return regexp.MustCompile("^" + strings.NewReplacer(
+		`\{name\}`, regexp.QuoteMeta(name),
+		`\{version\}`, `.+`,
+		`\{major\}`, `[0-9]+`,
+		`\{date\}`, `[0-9]{4}-[0-9]{2}-[0-9]{2}`,
+	).Replace(regexp.QuoteMeta(template)) + "$")
+}
+
+// The major version of the provider, from the module path of provider/go.mod.
+//
+// Providers without a major version suffix are at major version 1.
+func providerMajor(repo ProviderRepo) (int64, error) {
+	path := filepath.Join(*repo.providerDir(), "go.mod")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	modPath := modfile.ModulePath(data)
+	if modPath == "" {
+		return 0, fmt.Errorf("%s: no module path", path)
+	}
+	if indx := versionSuffix.FindStringIndex(modPath); indx != nil {
+		return strconv.ParseInt(modPath[indx[0]+len("/v"):], 10, 64)
+	}
+	return 1, nil
+}
+
+// Ask the user a yes or no question. Any answer but "y" or "yes" is a no.
+func confirm(question string) (bool, error) {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
 }
 
 func say(msg string) func([]byte) (string, error) {
@@ -149,41 +396,69 @@ func say(msg string) func([]byte) (string, error) {
 	}
 }
 
+// setCurrentUpstream sets repo.currentUpstreamVersion, based on the kind of the repo.
+func setCurrentUpstream(ctx Context, repo *ProviderRepo, goMod *GoMod) error {
+	switch {
+	case goMod.Kind == Submodule:
+		return setCurrentUpstreamFromSubmodule(ctx, repo, goMod.Submodule,
+			"https://"+upstreamRepoPath(ctx, goMod.Upstream.Path)+".git")
+	case goMod.Kind.IsPatched():
+		return setCurrentUpstreamFromPatched(ctx, repo)
+	case goMod.Kind.IsForked():
+		return setCurrentUpstreamFromForked(ctx, repo, goMod)
+	case goMod.Kind.IsShimmed():
+		return setCurrentUpstreamFromShimmed(ctx, repo, goMod)
+	case goMod.Kind == Plain:
+		return setCurrentUpstreamFromPlain(ctx, repo, goMod)
+	default:
+		return fmt.Errorf("Unexpected repo kind: %s", goMod.Kind)
+	}
+}
+
 // setCurrentUpstreamFromPatched sets repo.currentUpstreamVersion to the version pointed to in the
 // submodule in the default branch.
 //
 // We don't use the current branch, since applying a partial update could change the current branch,
 // leading to a non idempotent result.
 func setCurrentUpstreamFromPatched(ctx Context, repo *ProviderRepo) error {
-	getCheckedInCommit := exec.CommandContext(ctx,
-		"git", "ls-tree", repo.defaultBranch, "upstream", "--object-only")
-	getCheckedInCommit.Dir = repo.root
-
-	checkedInCommit, err := getCheckedInCommit.Output()
-	if err != nil {
-		return err
-	}
-	sha := bytes.TrimSpace(checkedInCommit)
-
 	ensureSubmoduleInit := exec.CommandContext(ctx,
 		"git", "submodule", "init")
 	ensureSubmoduleInit.Dir = repo.root
-	out, err := ensureSubmoduleInit.CombinedOutput()
+	out, err := traced(ensureSubmoduleInit).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to init submodule: %w: %s", err, string(out))
 	}
 	getRemoteURL := exec.CommandContext(ctx,
 		"git", "config", "--get", "submodule.upstream.url")
 	getRemoteURL.Dir = repo.root
-	remoteURLBytes, err := getRemoteURL.Output()
+	remoteURLBytes, err := traced(getRemoteURL).Output()
 	if err != nil {
 		return err
 	}
 	remoteURL := string(bytes.TrimSpace(remoteURLBytes))
+	if ctx.UpstreamOwnerRepo != "" {
+		remoteURL = "https://github.com/" + ctx.UpstreamOwnerRepo + ".git"
+	}
+
+	return setCurrentUpstreamFromSubmodule(ctx, repo, "upstream", remoteURL)
+}
+
+// setCurrentUpstreamFromSubmodule sets repo.currentUpstreamVersion to the tag of remoteURL
+// that matches the commit of the submodule at path in the default branch.
+func setCurrentUpstreamFromSubmodule(ctx Context, repo *ProviderRepo, path, remoteURL string) error {
+	getCheckedInCommit := exec.CommandContext(ctx,
+		"git", "ls-tree", repo.defaultBranch, path, "--object-only")
+	getCheckedInCommit.Dir = repo.root
+
+	checkedInCommit, err := traced(getCheckedInCommit).Output()
+	if err != nil {
+		return err
+	}
+	sha := bytes.TrimSpace(checkedInCommit)
 
 	getTags := exec.CommandContext(ctx,
 		"git", "ls-remote", "--tags", remoteURL)
-	allTags, err := getTags.Output()
+	allTags, err := traced(getTags).Output()
 	if err != nil {
 		return fmt.Errorf("failed to list remote tags for '%s': %w", remoteURL, err)
 	}
@@ -196,6 +471,7 @@ func setCurrentUpstreamFromPatched(ctx Context, repo *ProviderRepo) error {
 		}
 		ref := string(bytes.Split(bytes.TrimSpace(tag), []byte{'\t'})[1])
 		version = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(ref, "refs/tags/"), "^{}"))
+		version = strings.TrimPrefix(version, ctx.TagPrefix)
 	}
 	if version == "" {
 		return fmt.Errorf("No tags match expected SHA '%s'", string(sha))
@@ -217,7 +493,7 @@ func setCurrentUpstreamFromPatched(ctx Context, repo *ProviderRepo) error {
 func setCurrentUpstreamFromPlain(ctx Context, repo *ProviderRepo, goMod *GoMod) error {
 	return setUpstreamFromRemoteRepo(ctx, repo, "tags",
 		filepath.Join("provider", "go.mod"), goMod.Upstream.Path,
-		semver.NewVersion)
+		ctx.parseUpstreamTag)
 }
 
 func setCurrentUpstreamFromForked(ctx Context, repo *ProviderRepo, goMod *GoMod) error {
@@ -232,7 +508,7 @@ func setCurrentUpstreamFromForked(ctx Context, repo *ProviderRepo, goMod *GoMod)
 func setCurrentUpstreamFromShimmed(ctx Context, repo *ProviderRepo, goMod *GoMod) error {
 	return setUpstreamFromRemoteRepo(ctx, repo, "tags",
 		filepath.Join("provider", "shim", "go.mod"), goMod.Upstream.Path,
-		semver.NewVersion)
+		ctx.parseUpstreamTag)
 }
 
 func setUpstreamFromRemoteRepo(
@@ -254,7 +530,10 @@ func setUpstreamFromRemoteRepo(
 		}
 		// This will not happen for pulumi forks, since we use upstream branches
 		// instead of tags. It *will* happen for plain repos.
-		repo.currentUpstreamVersion = parsed
+		//
+		// An upstream without a go.mod is required as vX.Y.Z+incompatible, but its
+		// tag is vX.Y.Z.
+		repo.currentUpstreamVersion = withoutMetadata(parsed)
 		return nil
 	}
 
@@ -269,10 +548,10 @@ func setUpstreamFromRemoteRepo(
 	}
 
 	// We now fetch the set of tagged commits.
-	url := "https://" + modPathWithoutVersion(upstream) + ".git"
+	url := "https://" + upstreamRepoPath(ctx, upstream) + ".git"
 	getTagCommits := exec.CommandContext(ctx, "git", "ls-remote", "--"+kind, "--quiet", url)
 	getTagCommits.Dir = repo.root
-	tagCommits, err := getTagCommits.Output()
+	tagCommits, err := traced(getTagCommits).Output()
 	if err != nil {
 		return fmt.Errorf("failed to get remote %s from '%s': %w", kind, url, err)
 	}
@@ -302,15 +581,47 @@ func setUpstreamFromRemoteRepo(
 		repo.currentUpstreamVersion = version
 		return nil
 	}
+
+	// The pseudo-version references an untagged commit. If the pseudo-version is based on
+	// a tagged version, we treat that as the current version.
+	if base, err := module.PseudoVersionBase(version.Version); err == nil && base != "" {
+		parsed, err := semver.NewVersion(base)
+		if err == nil {
+			repo.currentUpstreamVersion = withoutMetadata(parsed)
+			return nil
+		}
+	}
 	return fmt.Errorf("no tag commit that matched '%s' in '%s'", rev, url)
 }
 
+// Find the SHA of the upstream tag for target in the repository at repoPath, such as
+// github.com/hashicorp/terraform-provider-aws.
+func lookupTagSHA(ctx Context, repoPath string, target *semver.Version) (string, error) {
+	refs, err := gitRefsOf(ctx, "https://"+repoPath, "tags")
+	if err != nil {
+		return "", err
+	}
+	if ref, ok := refs.shaOf("refs/tags/" + ctx.upstreamTag(target)); ok {
+		return ref, nil
+	}
+	return "", fmt.Errorf("could not find SHA for tag '%s'", target.Original())
+}
+
+// Find the SHA of the tag for target of upstream, an additional upstream of a composite
+// provider. ctx.UpstreamOwnerRepo only overrides the repo of the primary upstream, so the
+// repo is always found from the module path.
+func lookupAdditionalUpstreamSHA(
+	ctx Context, upstream module.Version, target *semver.Version,
+) (string, error) {
+	return lookupTagSHA(ctx, modPathWithoutVersion(upstream.Path), target)
+}
+
 func gitRefsOf(ctx context.Context, url, kind string) (gitRepoRefs, error) {
 	args := []string{"ls-remote", "--" + kind, url}
 	cmd := exec.CommandContext(ctx, "git", args...)
 	out := new(bytes.Buffer)
 	cmd.Stdout = out
-	if err := cmd.Run(); err != nil {
+	if err := traced(cmd).Run(); err != nil {
 		return gitRepoRefs{}, fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
 	}
 	refsToBranches := map[string]string{}
@@ -359,8 +670,8 @@ func (g gitRepoRefs) sortedLabels(less func(string, string) bool) []string {
 }
 
 func latestRelease(ctx context.Context, repo string) (*semver.Version, error) {
-	resultBytes, err := exec.CommandContext(ctx, "gh", "repo", "view",
-		repo, "--json=latestRelease").Output()
+	resultBytes, err := traced(exec.CommandContext(ctx, "gh", "repo", "view",
+		repo, "--json=latestRelease")).Output()
 	if err != nil {
 		return nil, err
 	}
@@ -377,6 +688,143 @@ func latestRelease(ctx context.Context, repo string) (*semver.Version, error) {
 	return semver.NewVersion(result.Latest.TagName)
 }
 
+// The tags of the releases of the GitHub repo ownerRepo that are neither drafts nor
+// prereleases, newest first. Every page of releases is listed, so old release lines are
+// included.
+func releaseTags(ctx context.Context, ownerRepo string) ([]string, error) {
+	out, err := traced(exec.CommandContext(ctx, "gh", "api", "--paginate",
+		"repos/"+ownerRepo+"/releases?per_page=100",
+		"--jq", ".[] | select((.draft or .prerelease) | not) | .tag_name")).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%w:\n%s", err, string(exit.Stderr))
+		}
+		return nil, fmt.Errorf("releases of %s: %w", ownerRepo, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// The highest version parsed from tags that satisfies constraint, or nil if there is none.
+// Tags that don't parse are ignored.
+func highestMatching(
+	tags []string, parse func(string) (*semver.Version, error), constraint *semver.Constraints,
+) *semver.Version {
+	var highest *semver.Version
+	for _, tag := range tags {
+		v, err := parse(tag)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		if highest == nil || highest.LessThan(v) {
+			highest = v
+		}
+	}
+	return highest
+}
+
+// The URL to clone the module at modulePath from.
+//
+// Modules hosted on GitHub are cloned directly. Other module paths may be vanity import
+// paths, so we resolve them with the go-import meta tag, the same way `go get` does.
+func repoCloneURL(ctx context.Context, modulePath string) (string, error) {
+	if strings.HasPrefix(modulePath, "github.com/") {
+		return "https://" + modulePath + ".git", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"https://"+modulePath+"?go-get=1", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", modulePath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving %s: unexpected status %s", modulePath, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", modulePath, err)
+	}
+	return parseGoImport(body, modulePath)
+}
+
+var goImportMeta = regexp.MustCompile(
+	`<meta\s+name=["']go-import["']\s+content=["']([^"']+)["']`)
+
+// Find the git repository of modulePath in the go-import meta tags of page.
+//
+// A go-import tag has the form `<meta name="go-import" content="prefix vcs url">`.
+func parseGoImport(page []byte, modulePath string) (string, error) {
+	for _, match := range goImportMeta.FindAllSubmatch(page, -1) {
+		fields := strings.Fields(string(match[1]))
+		if len(fields) != 3 {
+			continue
+		}
+		prefix, vcs, url := fields[0], fields[1], fields[2]
+		if prefix != modulePath && !strings.HasPrefix(modulePath, prefix+"/") {
+			continue
+		}
+		if vcs != "git" {
+			return "", fmt.Errorf("%s is hosted with %s, only git is supported", modulePath, vcs)
+		}
+		return url, nil
+	}
+	return "", fmt.Errorf("no go-import meta tag found for %s", modulePath)
+}
+
+// Parse the token scopes listed by `gh auth status`, such as:
+//
+//	Token scopes: 'gist', 'read:org', 'repo'
+//
+// false is returned if no scopes are listed.
+func parseTokenScopes(status string) (map[string]bool, bool) {
+	for _, line := range strings.Split(status, "\n") {
+		_, list, found := strings.Cut(line, "Token scopes:")
+		if !found {
+			continue
+		}
+		scopes := map[string]bool{}
+		for _, scope := range strings.Split(list, ",") {
+			scope = strings.Trim(strings.TrimSpace(scope), `'"`)
+			if scope != "" {
+				scopes[scope] = true
+			}
+		}
+		return scopes, true
+	}
+	return nil, false
+}
+
+// The path of the provider repo org/repo, such as github.com/pulumi/pulumi-aws.
+//
+// If ctx.ProviderRepoURL is set, the path is its host and path instead, such as
+// gitlab.example.com/providers/pulumi-aws for https://gitlab.example.com/providers/pulumi-aws.git
+// or git@gitlab.example.com:providers/pulumi-aws.git.
+func providerRepoPath(ctx Context, org, repo string) (string, error) {
+	if ctx.ProviderRepoURL == "" {
+		return path.Join("github.com", org, repo), nil
+	}
+	raw := ctx.ProviderRepoURL
+	if !strings.Contains(raw, "://") {
+		// An scp-like URL, such as git@host:org/repo.git.
+		if userHost, p, ok := strings.Cut(raw, ":"); ok {
+			raw = "ssh://" + userHost + "/" + p
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("--provider-repo-url: %w", err)
+	}
+	p := strings.Trim(strings.TrimSuffix(u.Path, ".git"), "/")
+	if u.Hostname() == "" || p == "" {
+		return "", fmt.Errorf("--provider-repo-url=%s: expected a URL with a host and a path",
+			ctx.ProviderRepoURL)
+	}
+	return u.Hostname() + "/" + p, nil
+}
+
 // getRepoExpectedLocation will return one of the following:
 // 1) --repo-path: if set, returns the specified repo path
 // 2) current working directory: returns the path to the cwd if it is a provider directory
@@ -421,67 +869,288 @@ func getRepoExpectedLocation(ctx Context, cwd, repoPath string) (string, error)
 // sorted by semantic version. The list may be empty.
 //
 // The second argument represents a message to describe the result. It may be empty.
-func GetExpectedTarget(ctx Context, name, upstreamOrg string) (*UpstreamUpgradeTarget, string, error) {
+//
+// If ctx.VersionConstraint is set, the target version must satisfy it.
+func GetExpectedTarget(ctx Context, name string, goMod *GoMod) (*UpstreamUpgradeTarget, string, error) {
+	target, msg, err := getExpectedTarget(ctx, name, goMod)
+	if err != nil || ctx.VersionConstraint == nil || target == nil || target.Version == nil {
+		return target, msg, err
+	}
+	if !ctx.VersionConstraint.Check(target.Version) {
+		return nil, "", fmt.Errorf("target version %s does not satisfy --version-constraint=%s",
+			target.Version, ctx.VersionConstraint)
+	}
+	return target, msg, nil
+}
+
+func getExpectedTarget(ctx Context, name string, goMod *GoMod) (*UpstreamUpgradeTarget, string, error) {
+	upstreamOrg := goMod.UpstreamProviderOrg
 	// InferVersion == true: use issue system, with ctx.TargetVersion limiting the version if set
 	if ctx.InferVersion {
 		return getExpectedTargetFromIssues(ctx, name)
 	}
+	if ctx.TargetFromUpstreamCheckout != "" {
+		return getExpectedTargetFromCheckout(ctx, ctx.TargetFromUpstreamCheckout)
+	}
+	if ctx.TargetBranchTip != "" {
+		return getExpectedTargetFromBranchTip(ctx, name, upstreamOrg)
+	}
+	if ctx.TargetLatestUpstreamRelease {
+		return getExpectedTargetLatestRelease(ctx, goMod)
+	}
+	if ctx.TargetFromBranch != "" {
+		v, err := versionFromBranchName(ctx, ctx.TargetFromBranch)
+		if err != nil {
+			return nil, "", err
+		}
+		return &UpstreamUpgradeTarget{Version: v}, " (from branch " + ctx.TargetFromBranch + ")", nil
+	}
 	if ctx.TargetVersion != nil {
 		return &UpstreamUpgradeTarget{Version: ctx.TargetVersion}, "", nil
 
 	}
+	if goMod.TargetDirective != "" {
+		v, err := ctx.ParseVersion(goMod.TargetDirective)
+		if err != nil {
+			return nil, "", fmt.Errorf("upgrade-target comment in go.mod: %w", err)
+		}
+		return &UpstreamUpgradeTarget{Version: v}, " (from the upgrade-target comment in go.mod)", nil
+	}
 	return getExpectedTargetLatest(ctx, name, upstreamOrg)
 }
 
 func getExpectedTargetLatest(ctx Context, name, upstreamOrg string) (*UpstreamUpgradeTarget, string, error) {
+	// With a constraint, the latest release might not be compatible, so we look through
+	// every release instead.
+	if ctx.VersionConstraint != nil {
+		tags, err := releaseTags(ctx, upstreamOwnerRepo(ctx, upstreamOrg))
+		if err != nil {
+			return nil, "", err
+		}
+		return highestCompatibleRelease(ctx, tags)
+	}
 	latest := exec.CommandContext(ctx, "gh", "release", "list",
-		"--repo="+upstreamOrg+"/"+ctx.UpstreamProviderName,
+		"--repo="+upstreamOwnerRepo(ctx, upstreamOrg),
 		"--limit=1",
 		"--exclude-drafts",
 		"--exclude-pre-releases")
 	bytes := new(bytes.Buffer)
 	latest.Stdout = bytes
-	err := latest.Run()
+	err := traced(latest).Run()
 	if err != nil {
 		return nil, "", err
 	}
 
 	tok := strings.Fields(bytes.String())
-	contract.Assertf(len(tok) > 0, fmt.Sprintf("no releases found in %s/%s", upstreamOrg, ctx.UpstreamProviderName))
-	v, err := semver.NewVersion(tok[0])
+	contract.Assertf(len(tok) > 0, fmt.Sprintf("no releases found in %s", upstreamOwnerRepo(ctx, upstreamOrg)))
+	v, err := ctx.parseUpstreamTag(tok[0])
 	if err != nil {
 		return nil, "", err
 	}
 	return &UpstreamUpgradeTarget{Version: v}, "", nil
 }
 
-func getExpectedTargetFromIssues(ctx Context, name string) (*UpstreamUpgradeTarget, string, error) {
-	target := &UpstreamUpgradeTarget{}
-	getIssues := exec.CommandContext(ctx, "gh", "issue", "list",
-		"--state=open",
-		"--author=pulumi-bot",
-		"--repo="+name,
-		"--limit=100",
-		"--json=title,number")
-	bytes := new(bytes.Buffer)
-	getIssues.Stdout = bytes
-	err := getIssues.Run()
+// Target the release that GitHub marks as the latest release of the upstream repo, which is
+// never a draft or a prerelease.
+//
+// The upstream repo is ctx.UpstreamOwnerRepo, or else found from the module path of the
+// upstream, so it doesn't depend on the name of the upstream provider.
+func getExpectedTargetLatestRelease(ctx Context, goMod *GoMod) (*UpstreamUpgradeTarget, string, error) {
+	org, repo, err := providerRepoFromModulePath(upstreamRepoPath(ctx, goMod.Upstream.Path))
 	if err != nil {
 		return nil, "", err
 	}
-	titles := []struct {
-		Title  string `json:"title"`
-		Number int    `json:"number"`
-	}{}
-	err = json.Unmarshal(bytes.Bytes(), &titles)
+	out, err := traced(exec.CommandContext(ctx, "gh", "release", "view",
+		"--repo="+org+"/"+repo, "--json=tagName")).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%w:\n%s", err, string(exit.Stderr))
+		}
+		return nil, "", fmt.Errorf("latest release of %s/%s: %w", org, repo, err)
+	}
+	var release struct {
+		TagName string `json:"tagName"`
+	}
+	if err := json.Unmarshal(out, &release); err != nil {
+		return nil, "", fmt.Errorf("latest release of %s/%s: %w", org, repo, err)
+	}
+	v, err := ctx.parseUpstreamTag(release.TagName)
+	if err != nil {
+		return nil, "", fmt.Errorf("latest release of %s/%s: tag '%s': %w", org, repo, release.TagName, err)
+	}
+	return &UpstreamUpgradeTarget{Version: v}, fmt.Sprintf(" (latest release of %s/%s)", org, repo), nil
+}
+
+// Select the highest release that satisfies ctx.VersionConstraint from the tags of the
+// releases of the upstream repo.
+func highestCompatibleRelease(ctx Context, tags []string) (*UpstreamUpgradeTarget, string, error) {
+	highest := highestMatching(tags, ctx.parseUpstreamTag, ctx.VersionConstraint)
+	if highest == nil {
+		return &UpstreamUpgradeTarget{}, noCompatibleUpgrade(ctx), nil
+	}
+	return &UpstreamUpgradeTarget{Version: highest}, "", nil
+}
+
+func noCompatibleUpgrade(ctx Context) string {
+	return fmt.Sprintf(" (no compatible upgrade for %s)", ctx.VersionConstraint)
+}
+
+// Target the commit at the tip of ctx.TargetBranchTip in the upstream repo.
+//
+// The version is ctx.TargetVersion if set, otherwise the latest upstream release.
+func getExpectedTargetFromBranchTip(ctx Context, name, upstreamOrg string) (*UpstreamUpgradeTarget, string, error) {
+	target := &UpstreamUpgradeTarget{Version: ctx.TargetVersion}
+	if target.Version == nil {
+		latest, _, err := getExpectedTargetLatest(ctx, name, upstreamOrg)
+		if err != nil {
+			return nil, "", err
+		}
+		target.Version = latest.Version
+	}
+	url := "https://github.com/" + upstreamOwnerRepo(ctx, upstreamOrg)
+	ref := "refs/heads/" + ctx.TargetBranchTip
+	sha, err := runGitCommand(ctx, func(b []byte) (string, error) {
+		sha, _, _ := strings.Cut(string(b), "\t")
+		return strings.TrimSpace(sha), nil
+	}, "ls-remote", url, ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("git ls-remote %s %s: %w", url, ref, err)
+	}
+	if sha == "" {
+		return nil, "", fmt.Errorf("branch '%s' not found in %s", ctx.TargetBranchTip, url)
+	}
+	target.SHA = sha
+	target.Branch = ctx.TargetBranchTip
+	return target, fmt.Sprintf(" (tip of %s at %s)", target.Branch, sha), nil
+}
+
+// A version at the end of a branch name, after a "/", "-" or "_" and an optional "v".
+var branchNameVersion = regexp.MustCompile(
+	`(?:^|[/_-])v?([0-9]+\.[0-9]+\.[0-9]+(?:-[0-9A-Za-z.]+)?)$`)
+
+// Parse the version that a branch name, such as "deps/upstream-v5.2.0", ends in.
+//
+// Any prefix is accepted, but the version must be a full MAJOR.MINOR.PATCH version.
+func versionFromBranchName(ctx Context, branch string) (*semver.Version, error) {
+	m := branchNameVersion.FindStringSubmatch(branch)
+	if m == nil {
+		return nil, fmt.Errorf("branch '%s' does not end in a MAJOR.MINOR.PATCH version", branch)
+	}
+	v, err := ctx.ParseVersion(m[1])
+	if err != nil {
+		return nil, fmt.Errorf("branch '%s': %w", branch, err)
+	}
+	return v, nil
+}
+
+// Target the commit checked out at path, a local checkout of the upstream provider. The
+// version is the most recent tag reachable from the checked out commit.
+//
+// The commit is only pinned if it is not the commit of the tag, and it must be pushed, so
+// it can be fetched by go and by the upgrade of a fork.
+func getExpectedTargetFromCheckout(ctx Context, path string) (*UpstreamUpgradeTarget, string, error) {
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = path
+		out, err := traced(cmd).Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: git %s: %w", path, strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	tag, err := git("describe", "--tags", "--abbrev=0")
+	if err != nil {
+		return nil, "", err
+	}
+	v, err := ctx.parseUpstreamTag(tag)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: tag '%s': %w", path, tag, err)
+	}
+	sha, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	tagSHA, err := git("rev-list", "-n", "1", tag)
+	if err != nil {
+		return nil, "", err
+	}
+	if sha == tagSHA {
+		return &UpstreamUpgradeTarget{Version: v}, " (at " + tag + ")", nil
+	}
+	remotes, err := git("branch", "--remotes", "--contains", sha)
+	if err != nil {
+		return nil, "", err
+	}
+	if remotes == "" {
+		return nil, "", fmt.Errorf("%s: commit %s is not on any remote branch, push it first", path, sha)
+	}
+	return &UpstreamUpgradeTarget{Version: v, SHA: sha}, " (at " + sha + ")", nil
+}
+
+type issueTitle struct {
+	Title  string `json:"title"`
+	Number int    `json:"number"`
+}
+
+// List the upgrade issues filed against the repo `name`, in ctx.IssueState.
+//
+// Unless ctx.AnyAuthor is set, only issues filed by pulumi-bot are listed.
+//
+// `gh issue list` returns at most --limit issues, so we list again with a larger limit
+// until fewer issues than the limit are returned.
+func listUpgradeIssues(ctx Context, name string) ([]issueTitle, error) {
+	limit := ctx.IssueLimit
+	if limit <= 0 {
+		limit = 100
+	}
+	state := ctx.IssueState
+	if state == "" {
+		state = "open"
+	}
+	for {
+		args := []string{"issue", "list",
+			"--state=" + state,
+			"--repo=" + name,
+			"--limit=" + strconv.Itoa(limit),
+			"--json=title,number"}
+		if !ctx.AnyAuthor {
+			args = append(args, "--author=pulumi-bot")
+		}
+		getIssues := exec.CommandContext(ctx, "gh", args...)
+		bytes := new(bytes.Buffer)
+		getIssues.Stdout = bytes
+		err := traced(getIssues).Run()
+		if err != nil {
+			return nil, err
+		}
+		titles := []issueTitle{}
+		err = json.Unmarshal(bytes.Bytes(), &titles)
+		if err != nil {
+			return nil, err
+		}
+		if len(titles) < limit {
+			return titles, nil
+		}
+		limit *= 2
+	}
+}
+
+func getExpectedTargetFromIssues(ctx Context, name string) (*UpstreamUpgradeTarget, string, error) {
+	target := &UpstreamUpgradeTarget{}
+	titles, err := listUpgradeIssues(ctx, name)
 	if err != nil {
 		return nil, "", err
 	}
 
 	var versions []UpgradeTargetIssue
-	var versionConstrained bool
+	var versionConstrained, incompatible bool
 	for _, title := range titles {
-		_, nameToVersion, found := strings.Cut(title.Title, "Upgrade terraform-provider-")
+		// Issues filed by humans are only considered if they look exactly like
+		// the issues filed by pulumi-bot.
+		prefix, nameToVersion, found := strings.Cut(title.Title, "Upgrade terraform-provider-")
+		if ctx.AnyAuthor && prefix != "" {
+			continue
+		}
 		if !found {
 			continue
 		}
@@ -489,18 +1158,30 @@ func getExpectedTargetFromIssues(ctx Context, name string) (*UpstreamUpgradeTarg
 		if !found {
 			continue
 		}
-		v, err := semver.NewVersion(version)
+		v, err := ctx.ParseVersion(version)
+		if err != nil && ctx.StrictSemver {
+			// With --strict-semver, a malformed version is an error instead of an
+			// issue to ignore.
+			return nil, "", fmt.Errorf("issue #%d %q: %w", title.Number, title.Title, err)
+		}
 		if err == nil {
 			if ctx.InferVersion && !(ctx.TargetVersion == nil || ctx.TargetVersion.Equal(v) || ctx.TargetVersion.GreaterThan(v)) {
 				versionConstrained = true
 				continue
 			}
+			if ctx.VersionConstraint != nil && !ctx.VersionConstraint.Check(v) {
+				incompatible = true
+				continue
+			}
 			versions = append(versions, UpgradeTargetIssue{
 				Version: v,
 				Number:  title.Number,
 			})
 		}
 	}
+	if len(versions) == 0 && incompatible {
+		return &UpstreamUpgradeTarget{}, noCompatibleUpgrade(ctx), nil
+	}
 	if len(versions) == 0 {
 		var extra string
 		if ctx.InferVersion && versionConstrained {
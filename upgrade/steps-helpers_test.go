@@ -1,13 +1,18 @@
 package upgrade
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 )
 
 func TestGetRepoExpectedLocation(t *testing.T) {
@@ -44,3 +49,324 @@ func trimSeparators(path string) string {
 	return strings.TrimSuffix(strings.TrimPrefix(path, string(os.PathSeparator)),
 		string(os.PathSeparator))
 }
+
+func TestCommitBody(t *testing.T) {
+	goMod := &GoMod{
+		Upstream: module.Version{
+			Path:    "github.com/hashicorp/terraform-provider-random/v3",
+			Version: "v3.4.0",
+		},
+		Bridge: module.Version{
+			Path:    "github.com/pulumi/pulumi-terraform-bridge/v3",
+			Version: "v3.40.0",
+		},
+	}
+	target := &UpstreamUpgradeTarget{Version: semver.MustParse("3.5.1")}
+
+	ctx := Context{UpgradeProviderVersion: true, UpgradeBridgeVersion: true}
+	assert.Equal(t, "Upgrade github.com/hashicorp/terraform-provider-random from v3.4.0 to v3.5.1\n"+
+		"Upgrade github.com/pulumi/pulumi-terraform-bridge from v3.40.0 to v3.41.0",
+		commitBody(ctx, ProviderRepo{}, target, goMod, "v3.41.0"))
+
+	ctx = Context{UpgradeBridgeVersion: true}
+	assert.Equal(t, "Upgrade github.com/pulumi/pulumi-terraform-bridge from v3.40.0 to v3.41.0",
+		commitBody(ctx, ProviderRepo{}, nil, goMod, "v3.41.0"))
+
+	assert.Equal(t, "", commitBody(Context{}, ProviderRepo{}, nil, goMod, ""))
+
+	target = &UpstreamUpgradeTarget{
+		Version: semver.MustParse("3.5.1"),
+		SHA:     "0123456789abcdef",
+		Branch:  "main",
+	}
+	ctx = Context{UpgradeProviderVersion: true}
+	assert.Equal(t, "Upgrade github.com/hashicorp/terraform-provider-random from v3.4.0 to v3.5.1"+
+		" (tip of branch main at 0123456789abcdef)",
+		commitBody(ctx, ProviderRepo{}, target, goMod, ""))
+}
+
+func TestParseGoImport(t *testing.T) {
+	page := []byte(`<html><head>
+<meta name="go-import" content="example.com/other git https://git.example.com/other">
+<meta name="go-import" content="example.com/tf git https://git.example.com/tf">
+</head></html>`)
+
+	url, err := parseGoImport(page, "example.com/tf")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://git.example.com/tf", url)
+
+	url, err = parseGoImport(page, "example.com/tf/v2")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://git.example.com/tf", url)
+
+	_, err = parseGoImport(page, "example.com/missing")
+	assert.Error(t, err)
+}
+
+func TestParseTokenScopes(t *testing.T) {
+	scopes, ok := parseTokenScopes(`github.com
+  ✓ Logged in to github.com account octocat (keyring)
+  - Active account: true
+  - Git operations protocol: https
+  - Token: gho_************************************
+  - Token scopes: 'gist', 'read:org', 'repo', 'workflow'
+`)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]bool{
+		"gist": true, "read:org": true, "repo": true, "workflow": true,
+	}, scopes)
+
+	_, ok = parseTokenScopes("  ✓ Logged in to github.com account octocat (GH_TOKEN)\n")
+	assert.False(t, ok)
+}
+
+func TestHighestMatching(t *testing.T) {
+	constraint, err := semver.NewConstraint("<3.60.0")
+	assert.NoError(t, err)
+	tags := []string{"v3.61.0", "v3.59.1", "not-a-version", "v3.59.0", "v3.58.2"}
+
+	v := highestMatching(tags, semver.NewVersion, constraint)
+	if assert.NotNil(t, v) {
+		assert.Equal(t, "v3.59.1", v.Original())
+	}
+
+	none, err := semver.NewConstraint(">4")
+	assert.NoError(t, err)
+	assert.Nil(t, highestMatching(tags, semver.NewVersion, none))
+}
+
+func TestHighestCompatibleRelease(t *testing.T) {
+	constraint, err := semver.NewConstraint("~5")
+	assert.NoError(t, err)
+	ctx := Context{TagPrefix: "v", VersionConstraint: constraint}
+
+	releases := []string{"v6.0.0", "v5.2.1", "v5.10.0", "v4.9.0"}
+	target, msg, err := highestCompatibleRelease(ctx, releases)
+	assert.NoError(t, err)
+	assert.Empty(t, msg)
+	assert.Equal(t, "5.10.0", target.Version.String())
+
+	target, msg, err = highestCompatibleRelease(ctx, []string{"v6.0.0"})
+	assert.NoError(t, err)
+	assert.Nil(t, target.Version)
+	assert.Contains(t, msg, "no compatible upgrade")
+}
+
+func TestDetectSDKLanguages(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"go", "nodejs", "python"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, "sdk", dir), 0700))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "sdk", "dotnet"), nil, 0600))
+
+	languages, err := detectSDKLanguages(root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go", "nodejs", "python"}, languages)
+
+	assert.Equal(t, []string{"build_sdks"}, Context{}.sdkBuildTargets())
+	assert.Equal(t, []string{"build_go", "build_nodejs"},
+		Context{SDKLanguages: []string{"go", "nodejs"}}.sdkBuildTargets())
+}
+
+func TestUpgradeBranch(t *testing.T) {
+	v := semver.MustParse("4.2.0")
+	ctx := Context{UpstreamProviderName: "terraform-provider-foo"}
+	assert.Equal(t, "upgrade-terraform-provider-foo-to-v4.2.0", providerUpgradeBranch(ctx, v, 5))
+	assert.Equal(t, "upgrade-pulumi-terraform-bridge-to-v3.60.0",
+		bridgeUpgradeBranch(ctx, "v3.60.0", 5))
+
+	ctx.BranchTemplate = "upgrade/v{major}/{name}-{version}"
+	assert.Equal(t, "upgrade/v5/terraform-provider-foo-v4.2.0", providerUpgradeBranch(ctx, v, 5))
+
+	ctx.BranchTemplate = "{name}-{date}"
+	assert.Equal(t, "terraform-provider-foo-"+time.Now().Format("2006-01-02"),
+		providerUpgradeBranch(ctx, v, 5))
+
+	assert.NoError(t, ValidateBranchTemplate("upgrade/v{major}/{name}-{version}-{date}"))
+	assert.Error(t, ValidateBranchTemplate("upgrade-{provider}"))
+	assert.Error(t, ValidateBranchTemplate("upgrade-{name"))
+}
+
+func TestProviderMajor(t *testing.T) {
+	tests := []struct {
+		module   string
+		expected int64
+	}{
+		{"github.com/pulumi/pulumi-foo/provider", 1},
+		{"github.com/pulumi/pulumi-foo/provider/v6", 6},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.module, func(t *testing.T) {
+			root := t.TempDir()
+			assert.NoError(t, os.MkdirAll(filepath.Join(root, "provider"), 0700))
+			assert.NoError(t, os.WriteFile(filepath.Join(root, "provider", "go.mod"),
+				[]byte("module "+tt.module+"\n"), 0600))
+			major, err := providerMajor(ProviderRepo{root: root})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, major)
+		})
+	}
+}
+
+func TestUpstreamOwnerRepoOverride(t *testing.T) {
+	ctx := Context{UpstreamProviderName: "terraform-provider-aws"}
+	const modPath = "github.com/hashicorp/terraform-provider-aws/v5"
+	assert.Equal(t, "github.com/hashicorp/terraform-provider-aws", upstreamRepoPath(ctx, modPath))
+	assert.Equal(t, "hashicorp/terraform-provider-aws", upstreamOwnerRepo(ctx, "hashicorp"))
+
+	ctx.UpstreamOwnerRepo = "example/aws-fork"
+	assert.Equal(t, "github.com/example/aws-fork", upstreamRepoPath(ctx, modPath))
+	assert.Equal(t, "example/aws-fork", upstreamOwnerRepo(ctx, "hashicorp"))
+
+	// The override is used as is, without the terraform-providers remap.
+	ctx.GoPath = "/go"
+	location, err := getRepoExpectedLocation(ctx, "/",
+		upstreamRepoPath(ctx, "github.com/terraform-providers/terraform-provider-unknown"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/go", "src", "github.com", "example", "aws-fork"), location)
+}
+
+func TestVersionFromBranchName(t *testing.T) {
+	ctx := Context{}
+	tests := []struct {
+		branch, expected string
+	}{
+		{"deps/upstream-v5.2.0", "5.2.0"},
+		{"upgrade_1.0.3", "1.0.3"},
+		{"v2.3.4", "2.3.4"},
+		{"release/v2.3.4-beta.1", "2.3.4-beta.1"},
+		{"deps/upstream-v5.2", ""},
+		{"deps/upstream-v5.2.0-rc", "5.2.0-rc"},
+		{"deps/upstreamv5.2.0", ""},
+		{"main", ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.branch, func(t *testing.T) {
+			v, err := versionFromBranchName(ctx, tt.branch)
+			if tt.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, v.String())
+		})
+	}
+}
+
+func TestGetExpectedTargetFromCheckout(t *testing.T) {
+	dir := newTestRepo(t)
+	git := func(args ...string) string { return runGit(t, dir, nil, args...) }
+	git("commit", "--quiet", "--allow-empty", "-m", "release")
+	git("tag", "v1.2.0")
+
+	ctx := Context{Context: context.Background(), TagPrefix: "v"}
+
+	// At the tag, the tag itself is targeted.
+	target, _, err := getExpectedTargetFromCheckout(ctx, dir)
+	assert.NoError(t, err)
+	if assert.NotNil(t, target) {
+		assert.Equal(t, "1.2.0", target.Version.String())
+		assert.Empty(t, target.SHA)
+	}
+
+	// A commit past the tag must be pushed before it is pinned.
+	git("commit", "--quiet", "--allow-empty", "-m", "fix")
+	sha := git("rev-parse", "HEAD")
+	_, _, err = getExpectedTargetFromCheckout(ctx, dir)
+	assert.ErrorContains(t, err, "is not on any remote branch")
+
+	git("update-ref", "refs/remotes/origin/main", "HEAD")
+	target, _, err = getExpectedTargetFromCheckout(ctx, dir)
+	assert.NoError(t, err)
+	if assert.NotNil(t, target) {
+		assert.Equal(t, "1.2.0", target.Version.String())
+		assert.Equal(t, sha, target.SHA)
+	}
+}
+
+func TestLookupAdditionalUpstreamSHA(t *testing.T) {
+	root := t.TempDir()
+	// Clone URLs of github.com repos point to repos in root.
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "url.file://"+root+"/.insteadOf")
+	t.Setenv("GIT_CONFIG_VALUE_0", "https://")
+	tagged := func(path string) string {
+		dir := filepath.Join(root, path)
+		assert.NoError(t, os.MkdirAll(dir, 0700))
+		git := func(args ...string) string { return runGit(t, dir, nil, args...) }
+		git("init", "--quiet")
+		git("commit", "--quiet", "--allow-empty", "-m", path)
+		git("tag", "v1.0.0")
+		return git("rev-parse", "HEAD")
+	}
+	primary := tagged("github.com/pulumi/terraform-provider-foo")
+	additional := tagged("github.com/hashicorp/terraform-provider-bar")
+
+	ctx := Context{
+		Context:           context.Background(),
+		TagPrefix:         "v",
+		UpstreamOwnerRepo: "pulumi/terraform-provider-foo",
+		AdditionalUpstreams: map[string]*semver.Version{
+			"bar": semver.MustParse("1.0.0"),
+		},
+	}
+	target := semver.MustParse("1.0.0")
+
+	sha, err := lookupTagSHA(ctx,
+		upstreamRepoPath(ctx, "github.com/hashicorp/terraform-provider-foo"), target)
+	assert.NoError(t, err)
+	assert.Equal(t, primary, sha)
+
+	// --upstream-owner-repo doesn't apply to additional upstreams.
+	sha, err = lookupAdditionalUpstreamSHA(ctx,
+		module.Version{Path: "github.com/hashicorp/terraform-provider-bar/v2"}, target)
+	assert.NoError(t, err)
+	assert.Equal(t, additional, sha)
+}
+
+func TestProviderRepoPath(t *testing.T) {
+	tests := []struct {
+		url, expected string
+	}{
+		{"", "github.com/pulumi/pulumi-foo"},
+		{"https://gitlab.example.com/providers/pulumi-foo.git", "gitlab.example.com/providers/pulumi-foo"},
+		{"git@gitlab.example.com:providers/pulumi-foo.git", "gitlab.example.com/providers/pulumi-foo"},
+		{"ssh://git@example.com:2222/pulumi-foo", "example.com/pulumi-foo"},
+		{"https://example.com", ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.url, func(t *testing.T) {
+			p, err := providerRepoPath(Context{ProviderRepoURL: tt.url}, "pulumi", "pulumi-foo")
+			if tt.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, p)
+		})
+	}
+}
+
+func TestForkRepoPath(t *testing.T) {
+	tests := []struct{ path, expected string }{
+		{"github.com/pulumi/terraform-provider-aws", "github.com/pulumi/terraform-provider-aws"},
+		{"github.com/pulumi/terraform-provider-aws/v5", "github.com/pulumi/terraform-provider-aws"},
+		{"github.com/pulumi/terraform-provider-aws/internal/provider",
+			"github.com/pulumi/terraform-provider-aws"},
+		{"go.example.com/terraform-provider-foo/v2", "go.example.com/terraform-provider-foo"},
+	}
+	// A nested module of the fork repo is accepted as a fork, so it must resolve to the repo.
+	isFork, err := isPulumiFork(&modfile.Replace{
+		Old: module.Version{Path: "github.com/hashicorp/terraform-provider-aws"},
+		New: module.Version{Path: "github.com/pulumi/terraform-provider-aws/internal/provider"},
+	}, "terraform-provider-aws")
+	assert.NoError(t, err)
+	assert.True(t, isFork)
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, forkRepoPath(tt.path), tt.path)
+	}
+}
@@ -4,14 +4,17 @@ package upgrade
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	semver "github.com/Masterminds/semver/v3"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
@@ -19,15 +22,18 @@ import (
 	"golang.org/x/mod/module"
 	"gopkg.in/yaml.v3"
 
+	"github.com/pulumi/upgrade-provider/colorize"
 	"github.com/pulumi/upgrade-provider/step"
 )
 
 // A "git commit" step that is resilient to no changes in the directory.
 // ß
 // This is required to accommodate failure and retry in the `git` push steps.
-func GitCommit(ctx context.Context, msg string) step.Step {
+//
+// If body is non-empty, it is added as the commit message body.
+func GitCommit(ctx Context, msg, body string) step.Step {
 	return step.Computed(func() step.Step {
-		check, err := exec.CommandContext(ctx, "git", "status", "--porcelain=1").CombinedOutput()
+		check, err := traced(exec.CommandContext(ctx, "git", "status", "--porcelain=1")).CombinedOutput()
 		description := fmt.Sprintf(`git commit -m "%s"`, msg)
 		if err != nil {
 			return step.F("git commit", func() (string, error) {
@@ -35,23 +41,170 @@ func GitCommit(ctx context.Context, msg string) step.Step {
 			})
 		}
 		if len(check) > 0 {
-			return step.Cmd(exec.CommandContext(ctx, "git", "commit", "-m", msg))
+			args := []string{"-m", msg}
+			if body != "" {
+				args = append(args, "-m", body)
+			}
+			return step.Cmd(gitCommitCmd(ctx, args...))
 		}
 		return step.F(description, func() (string, error) {
-			return "nothing to commit", nil
+			return "", step.Skipf("nothing to commit")
 		})
 	})
 }
 
 // Upgrade the upstream fork of a pulumi provider.
 //
-// The SHA of the new upstream branch is returned.
-func upgradeUpstreamFork(ctx Context, name string, target *semver.Version, goMod *GoMod) step.Step {
+// The returned function releases the upstream checkout, and must be called once the
+// returned step has run.
+//
+// The tag of target is merged into the upstream branch, or the upstream commit sha if it is
+// set. The SHA of the new upstream branch is returned, unless ctx.ForkUpstreamCommit pins a
+// different commit.
+func upgradeUpstreamFork(
+	ctx Context, name string, target *semver.Version, sha string, goMod *GoMod,
+) (step.Step, func()) {
 	var forkedProviderUpstreamCommit string
 	var upstreamPath string
 	var previousUpstreamVersion *semver.Version
+	upstreamRepo := upstreamRepoPath(ctx, goMod.Fork.Old.Path)
+
+	// The upstream checkout may be shared with concurrent upgrades of other providers,
+	// so we either lock it or clone a private copy.
+	var tempDir string
+	release := func() {}
+	var checkout step.Step
+	if ctx.Isolated {
+		checkout = step.Combined("Isolated Checkout",
+			step.F("Temporary Directory", func() (string, error) {
+				var err error
+				tempDir, err = os.MkdirTemp("", "upgrade-provider-")
+				if err != nil {
+					return "", err
+				}
+				release = func() { os.RemoveAll(tempDir) }
+				upstreamPath = filepath.Join(tempDir, filepath.Base(upstreamRepo))
+				return tempDir, nil
+			}),
+			step.Computed(func() step.Step {
+				url, err := repoCloneURL(ctx, upstreamRepo)
+				if err != nil {
+					return step.F("Resolving Clone URL", func() (string, error) { return "", err })
+				}
+				return step.Cmd(exec.CommandContext(ctx, "git", "clone", url, upstreamPath))
+			}),
+		)
+	} else {
+		checkout = step.Combined("Shared Checkout",
+			ensureUpstreamRepo(ctx, upstreamRepo).AssignTo(&upstreamPath),
+			step.F("Lock Checkout", func() (string, error) {
+				unlock, err := lockCheckout(ctx, upstreamPath, lockCheckoutWait)
+				if err != nil {
+					return "", err
+				}
+				release = unlock
+				return upstreamPath + ".lock", nil
+			}),
+		)
+	}
+
+	// We merge the local tag, so we make sure that it is present even when `git fetch
+	// --tags` did not bring it in (such as when the local tag diverges from the remote tag).
+	mergeRef := ctx.upstreamTag(target)
+	fetchMergeRef := step.Cmd(exec.CommandContext(ctx, "git", "fetch", "--force", "origin",
+		"refs/tags/"+mergeRef+":refs/tags/"+mergeRef))
+	if sha != "" {
+		mergeRef = sha
+		fetchMergeRef = step.Cmd(exec.CommandContext(ctx, "git", "fetch", "origin", sha))
+	}
+
+	// With --continue, a human already resolved the conflicts of a previous merge, so we
+	// pick up after it.
+	var merge step.Step
+	if ctx.ContinueMerge {
+		merge = verifyResolvedMerge(ctx, target).In(&upstreamPath)
+	} else {
+		merge = step.Combined("Merge Upstream",
+			ensureCleanUpstream(ctx).In(&upstreamPath),
+			// Merging requires the full history, so we undo --clone-depth.
+			step.Computed(func() step.Step {
+				shallow, err := runGitCommand(ctx, func(b []byte) (bool, error) {
+					return strings.TrimSpace(string(b)) == "true", nil
+				}, "rev-parse", "--is-shallow-repository")
+				if err != nil {
+					return step.F("Unshallow", func() (string, error) { return "", err })
+				}
+				if !shallow {
+					return nil
+				}
+				return step.Cmd(exec.CommandContext(ctx, "git", "fetch", "--unshallow", "origin"))
+			}).In(&upstreamPath),
+			step.Cmd(exec.CommandContext(ctx, "git", "fetch", "pulumi")).In(&upstreamPath),
+			step.Cmd(exec.CommandContext(ctx, "git", "fetch", "origin", "--tags")).In(&upstreamPath),
+			step.F("Discover Previous Upstream Version", func() (string, error) {
+				return runGitCommand(ctx, func(b []byte) (string, error) {
+					lines := strings.Split(string(b), "\n")
+					for _, line := range lines {
+						line = strings.TrimSpace(line)
+						version, err := semver.NewVersion(strings.TrimPrefix(line, "pulumi/upstream-v"))
+						if err != nil {
+							continue
+						}
+						if previousUpstreamVersion == nil || previousUpstreamVersion.LessThan(version) {
+							previousUpstreamVersion = version
+						}
+					}
+					if previousUpstreamVersion == nil {
+						return "", fmt.Errorf("no version found")
+					}
+					return previousUpstreamVersion.String(), nil
+				}, "branch", "--remote", "--list", "pulumi/upstream-v*")
+			}).In(&upstreamPath),
+			step.Computed(func() step.Step {
+				return step.Cmd(exec.CommandContext(ctx,
+					"git", "checkout", "pulumi/upstream-v"+previousUpstreamVersion.String()))
+			}).In(&upstreamPath),
+			step.F("Upstream Branch", func() (string, error) {
+				target := "upstream-v" + target.String()
+				branchExists, err := runGitCommand(ctx, func(b []byte) (bool, error) {
+					lines := strings.Split(string(b), "\n")
+					for _, line := range lines {
+						line = strings.TrimSpace(line)
+						if line == target || line == "* "+target {
+							return true, nil
+						}
+					}
+					return false, nil
+				}, "branch")
+				if err != nil {
+					return "", err
+				}
+				if !branchExists {
+					return runGitCommand(ctx, say("creating "+target),
+						"checkout", "-b", target)
+				}
+				// We always end on the target branch, since we are otherwise left on
+				// the detached previous upstream version.
+				return runGitCommand(ctx, say(target+" already exists, checked out"),
+					"checkout", target)
+			}).In(&upstreamPath),
+			fetchMergeRef.In(&upstreamPath),
+			step.F("Merge "+mergeRef, func() (string, error) {
+				out, err := traced(exec.CommandContext(ctx, "git", "merge", mergeRef)).CombinedOutput()
+				if err != nil && bytes.Contains(out, []byte("CONFLICT")) {
+					return "", fmt.Errorf("merge conflicts in %s:\n%s\n"+
+						"Resolve the conflicts and commit the merge, then run again with --continue",
+						upstreamPath, string(out))
+				} else if err != nil {
+					return "", fmt.Errorf("git merge: %w:\n%s", err, string(out))
+				}
+				return "", nil
+			}).In(&upstreamPath),
+		)
+	}
+
 	return step.Combined("Upgrading Forked Provider",
-		ensureUpstreamRepo(ctx, goMod.Fork.Old.Path).AssignTo(&upstreamPath),
+		checkout,
 		step.F("Ensure Pulumi Remote", func() (string, error) {
 			remoteName := strings.TrimPrefix(name, "pulumi-")
 			if s, ok := ProviderName[remoteName]; ok {
@@ -59,65 +212,167 @@ func upgradeUpstreamFork(ctx Context, name string, target *semver.Version, goMod
 			}
 			return ensurePulumiRemote(ctx, remoteName)
 		}).In(&upstreamPath),
-		step.Cmd(exec.Command("git", "fetch", "pulumi")).In(&upstreamPath),
-		step.Cmd(exec.Command("git", "fetch", "origin", "--tags")).In(&upstreamPath),
-		step.F("Discover Previous Upstream Version", func() (string, error) {
-			return runGitCommand(ctx, func(b []byte) (string, error) {
-				lines := strings.Split(string(b), "\n")
-				for _, line := range lines {
-					line = strings.TrimSpace(line)
-					version, err := semver.NewVersion(strings.TrimPrefix(line, "pulumi/upstream-v"))
+		merge,
+		bumpTransitiveForks(ctx).In(&upstreamPath),
+		step.Cmd(goCmd(ctx, "build", ".")).In(&upstreamPath),
+		step.Cmd(exec.CommandContext(ctx,
+			"git", "push", "pulumi", "upstream-v"+target.String())).In(&upstreamPath),
+		step.Computed(func() step.Step {
+			if ctx.ForkUpstreamCommit != "" {
+				return step.F("Pinned Fork Commit", func() (string, error) {
+					return ctx.ForkUpstreamCommit, nil
+				})
+			}
+			return step.F("Get Head Commit", func() (string, error) {
+				return runGitCommand(ctx, func(b []byte) (string, error) {
+					return strings.TrimSpace(string(b)), nil
+				}, "rev-parse", "HEAD")
+			})
+		}).AssignTo(&forkedProviderUpstreamCommit).In(&upstreamPath),
+	).Return(&forkedProviderUpstreamCommit), func() { release() }
+}
+
+// Bump the replaces in the go.mod of the fork that point to other pulumi maintained forks,
+// such as a fork of one of the upstream's dependencies, to the head of the fork's branch
+// for the required version of the dependency, such as upstream-v1.2.3.
+//
+// Changes are committed to the fork, so they are pushed with the upgraded upstream.
+func bumpTransitiveForks(ctx Context) step.Step {
+	name := "Bump Transitive Forks"
+	return step.Computed(func() step.Step {
+		if !ctx.BumpTransitiveForks {
+			return nil
+		}
+		fail := func(err error) step.Step {
+			return step.F(name, func() (string, error) { return "", err })
+		}
+		data, err := os.ReadFile("go.mod")
+		if err != nil {
+			return fail(fmt.Errorf("could not find go.mod: %w", err))
+		}
+		goMod, err := modfile.Parse("go.mod", data, nil)
+		if err != nil {
+			return fail(fmt.Errorf("could not parse go.mod: %w", err))
+		}
+		forks := pulumiForkReplaces(goMod)
+		if len(forks) == 0 {
+			return nil
+		}
+
+		steps := []step.Step{}
+		for _, replace := range forks {
+			replace := replace
+			var sha string
+			steps = append(steps, step.Combined("Bump "+replace.New.Path,
+				step.F("Fork Branch Head", func() (string, error) {
+					branch, err := transitiveForkBranch(goMod, replace)
 					if err != nil {
-						continue
+						return "", err
 					}
-					if previousUpstreamVersion == nil || previousUpstreamVersion.LessThan(version) {
-						previousUpstreamVersion = version
+					url, err := repoCloneURL(ctx, forkRepoPath(replace.New.Path))
+					if err != nil {
+						return "", err
 					}
+					return runGitCommand(ctx, func(b []byte) (string, error) {
+						sha, _, _ := strings.Cut(string(b), "\t")
+						if sha = strings.TrimSpace(sha); sha == "" {
+							return "", fmt.Errorf("no %s branch found in %s", branch, url)
+						}
+						return sha, nil
+					}, "ls-remote", url, "refs/heads/"+branch)
+				}).AssignTo(&sha),
+				step.Computed(func() step.Step {
+					return step.Cmd(exec.CommandContext(ctx, "go", "mod", "edit", "-replace",
+						replace.Old.String()+"="+replace.New.Path+"@"+sha))
+				}),
+			))
+		}
+		steps = append(steps,
+			step.Cmd(goCmd(ctx, "mod", "tidy")),
+			step.F("Commit", func() (string, error) {
+				changed, err := runGitCommand(ctx, func(b []byte) (bool, error) {
+					return len(bytes.TrimSpace(b)) > 0, nil
+				}, "status", "--porcelain", "--", "go.mod", "go.sum")
+				if err != nil {
+					return "", err
+				} else if !changed {
+					return "", step.Skipf("no changes")
 				}
-				if previousUpstreamVersion == nil {
-					return "", fmt.Errorf("no version found")
-				}
-				return previousUpstreamVersion.String(), nil
-			}, "branch", "--remote", "--list", "pulumi/upstream-v*")
-		}).In(&upstreamPath),
-		step.Computed(func() step.Step {
-			return step.Cmd(exec.CommandContext(ctx,
-				"git", "checkout", "pulumi/upstream-v"+previousUpstreamVersion.String()))
-		}).In(&upstreamPath),
-		step.F("Upstream Branch", func() (string, error) {
-			target := "upstream-v" + target.String()
-			branchExists, err := runGitCommand(ctx, func(b []byte) (bool, error) {
-				lines := strings.Split(string(b), "\n")
-				for _, line := range lines {
-					if strings.TrimSpace(line) == target {
-						return true, nil
-					}
+				out, err := traced(gitCommitCmd(ctx,
+					"-m", "Bump transitive forks", "--", "go.mod", "go.sum")).CombinedOutput()
+				if err != nil {
+					return "", fmt.Errorf("git commit: %w:\n%s", err, string(out))
 				}
-				return false, nil
-			}, "branch")
-			if err != nil {
-				return "", err
-			}
-			if !branchExists {
-				return runGitCommand(ctx, say("creating "+target),
-					"checkout", "-b", target)
+				return "committed", nil
+			}))
+		return step.Combined(name, steps...)
+	})
+}
+
+// Check that the merge of the upstream tag into the upstream-v{target} branch was
+// completed by hand, after resolving its conflicts.
+func verifyResolvedMerge(ctx Context, target *semver.Version) step.Step {
+	return step.F("Verify Resolved Merge", func() (string, error) {
+		tag := ctx.upstreamTag(target)
+		if _, err := runGitCommand[any](ctx, nil,
+			"rev-parse", "--verify", "--quiet", "MERGE_HEAD"); err == nil {
+			return "", fmt.Errorf("the merge of %s is still in progress: commit it before continuing", tag)
+		}
+		branch, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			return strings.TrimSpace(string(b)), nil
+		}, "symbolic-ref", "--quiet", "--short", "HEAD")
+		if expected := "upstream-v" + target.String(); err != nil || branch != expected {
+			return "", fmt.Errorf("expected %s to be checked out", expected)
+		}
+		if _, err := runGitCommand[any](ctx, nil, "merge-base", "--is-ancestor", tag, "HEAD"); err != nil {
+			return "", fmt.Errorf("%s is not merged into %s", tag, branch)
+		}
+		return tag + " merged into " + branch, nil
+	})
+}
+
+// Check that the upstream checkout has no leftovers of an interrupted run, such as an
+// unfinished merge or uncommitted changes, which make checking out the previous upstream
+// version fail. If ctx.ResetUpstream is set, the leftovers are discarded instead.
+func ensureCleanUpstream(ctx Context) step.Step {
+	return step.F("Clean Upstream Checkout", func() (string, error) {
+		_, err := runGitCommand[any](ctx, nil, "rev-parse", "--verify", "--quiet", "MERGE_HEAD")
+		merging := err == nil
+		changes, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			return strings.TrimSpace(string(b)), nil
+		}, "status", "--porcelain", "--untracked-files=no")
+		if err != nil {
+			return "", err
+		}
+		if !merging && changes == "" {
+			return "clean", nil
+		}
+		if !ctx.ResetUpstream {
+			return "", fmt.Errorf("the upstream checkout has an unfinished merge or uncommitted "+
+				"changes, likely from an interrupted run:\n%s\n"+
+				"Commit a resolved merge and run again with --continue, "+
+				"or pass --reset-upstream to discard them", changes)
+		}
+		if merging {
+			if _, err := runGitCommand[any](ctx, nil, "merge", "--abort"); err != nil {
+				return "", fmt.Errorf("git merge --abort: %w", err)
 			}
-			return target + " already exists", nil
-		}).In(&upstreamPath),
-		step.Cmd(exec.CommandContext(ctx,
-			"git", "merge", "v"+target.String())).In(&upstreamPath),
-		step.Cmd(exec.CommandContext(ctx, "go", "build", ".")).In(&upstreamPath),
-		step.Cmd(exec.CommandContext(ctx,
-			"git", "push", "pulumi", "upstream-v"+target.String())).In(&upstreamPath),
-		step.F("Get Head Commit", func() (string, error) {
-			return runGitCommand(ctx, func(b []byte) (string, error) {
-				return strings.TrimSpace(string(b)), nil
-			}, "rev-parse", "HEAD")
-		}).AssignTo(&forkedProviderUpstreamCommit).In(&upstreamPath),
-	).Return(&forkedProviderUpstreamCommit)
+		}
+		if _, err := runGitCommand[any](ctx, nil, "reset", "--hard"); err != nil {
+			return "", fmt.Errorf("git reset --hard: %w", err)
+		}
+		return colorize.Warn("discarded an unfinished merge or uncommitted changes"), nil
+	})
 }
 
 func ensureUpstreamRepo(ctx Context, repoPath string) step.Step {
+	return ensureRepo(ctx, repoPath, "")
+}
+
+// Ensure that the repo at repoPath is checked out, cloning it from cloneURL if it isn't.
+//
+// If cloneURL is empty, it is resolved from repoPath.
+func ensureRepo(ctx Context, repoPath, cloneURL string) step.Step {
 	var expectedLocation string
 	var repoExists bool
 	return step.Combined("Ensure '"+repoPath+"'",
@@ -142,7 +397,7 @@ func ensureUpstreamRepo(ctx Context, repoPath string) step.Step {
 			const tag = "Downloading"
 			if repoExists {
 				return step.F(tag, func() (string, error) {
-					return "skipped - already exists", nil
+					return "", step.Skipf("already exists")
 				})
 			}
 			targetDir := filepath.Dir(expectedLocation)
@@ -154,13 +409,26 @@ func ensureUpstreamRepo(ctx Context, repoPath string) step.Step {
 					}
 					return "", nil
 				}),
-				step.Cmd(exec.CommandContext(ctx, "git", "clone",
-					fmt.Sprintf("https://%s.git", repoPath),
-					expectedLocation)),
+				step.F("Resolving Clone URL", func() (string, error) {
+					if cloneURL != "" {
+						return cloneURL, nil
+					}
+					var err error
+					cloneURL, err = repoCloneURL(ctx, repoPath)
+					return cloneURL, err
+				}),
+				step.Computed(func() step.Step {
+					args := []string{"clone"}
+					if ctx.CloneDepth > 0 {
+						args = append(args, "--depth", fmt.Sprint(ctx.CloneDepth))
+					}
+					return step.Cmd(exec.CommandContext(ctx, "git", append(args,
+						cloneURL, expectedLocation)...))
+				}),
 			)
 		}),
 		step.F("Validating", func() (string, error) {
-			return "done", exec.CommandContext(ctx, "git", "status", "--short").Run()
+			return "done", traced(exec.CommandContext(ctx, "git", "status", "--short")).Run()
 		}).In(&expectedLocation),
 	).Return(&expectedLocation)
 }
@@ -181,7 +449,7 @@ func UpgradeProviderVersion(
 			step.Cmd(exec.CommandContext(ctx, "git", "fetch", "--tags")).In(&upstreamDir),
 			// We need to remove any patches to so we can cleanly pull the next upstream version.
 			step.Cmd(exec.CommandContext(ctx, "git", "reset", "HEAD", "--hard")).In(&upstreamDir),
-			step.Cmd(exec.CommandContext(ctx, "git", "checkout", "tags/v"+target.String())).In(&upstreamDir),
+			step.Cmd(exec.CommandContext(ctx, "git", "checkout", "tags/"+ctx.upstreamTag(target))).In(&upstreamDir),
 			step.Cmd(exec.CommandContext(ctx, "git", "add", "upstream")).In(&repo.root),
 			// We re-apply changes, eagerly.
 			//
@@ -189,7 +457,19 @@ func UpgradeProviderVersion(
 			// example, we might have a patched in shim dir that is not yet
 			// restored, causing `go mod tidy` to fail, even where `make
 			// provider` would succeed.
-			step.Cmd(exec.CommandContext(ctx, "make", "upstream")).In(&repo.root),
+			step.Cmd(makeCmd(ctx, "upstream")).In(&repo.root),
+		))
+	}
+	if goMod.Kind == Submodule {
+		// The upstream is only referenced as a submodule, so we check out the new tag.
+		submoduleDir := filepath.Join(repo.root, goMod.Submodule)
+		steps = append(steps, step.Combined("update upstream submodule",
+			step.Cmd(exec.CommandContext(ctx,
+				"git", "submodule", "update", "--init", goMod.Submodule)).In(&repo.root),
+			step.Cmd(exec.CommandContext(ctx, "git", "fetch", "--tags")).In(&submoduleDir),
+			step.Cmd(exec.CommandContext(ctx,
+				"git", "checkout", "tags/"+ctx.upstreamTag(target))).In(&submoduleDir),
+			step.Cmd(exec.CommandContext(ctx, "git", "add", goMod.Submodule)).In(&repo.root),
 		))
 	}
 	// We first check if the provider is patched, and ensure the upstream is initialized if so.
@@ -197,36 +477,7 @@ func UpgradeProviderVersion(
 	// We then start by updating the terraform-plugin-sdk because later updates sometimes
 	// rely on it.
 
-	steps = append(steps, updateLatestPluginSDK,
-		// If we updated the pinned plugin sdk, then we need to run `go mod tidy`
-		// to normalize the ref.
-		step.Computed(func() step.Step {
-			if !(*didUpdate) {
-				return nil
-			}
-			return step.Cmd(exec.CommandContext(ctx, "go", "mod", "tidy")).
-				In(repo.providerDir())
-		}))
-
-	if !goMod.Kind.IsForked() {
-		// We have an upstream we don't control, so we need to get it's SHA. We do this
-		// instead of using version tags because we can't ensure that the upstream is
-		// versioning their go modules correctly.
-		//
-		// It they are versioning correctly, `go mod tidy` will resolve the SHA to a tag.
-		steps = append(steps,
-			step.F("Lookup Tag SHA", func() (string, error) {
-				refs, err := gitRefsOf(ctx, "https://"+modPathWithoutVersion(goMod.Upstream.Path),
-					"tags")
-				if err != nil {
-					return "", err
-				}
-				if ref, ok := refs.shaOf("refs/tags/v" + target.String()); ok {
-					return ref, nil
-				}
-				return "", fmt.Errorf("could not find SHA for tag '%s'", target.Original())
-			}).AssignTo(&targetSHA))
-	}
+	steps = append(steps, updateLatestPluginSDK)
 
 	// goModDir is the directory of the go.mod where we reference the upstream provider.
 	goModDir := *repo.providerDir()
@@ -240,9 +491,9 @@ func UpgradeProviderVersion(
 	// update. Because Go includes major versions as part of its module path, making
 	// this correct can break on major version updates. We just leave it if its not
 	// necessary to touch.
-	if !goMod.Kind.IsPatched() && !goMod.Kind.IsForked() {
+	if !goMod.Kind.IsPatched() && !goMod.Kind.IsForked() && goMod.Kind != Submodule {
 		steps = append(steps, step.Computed(func() step.Step {
-			targetV := "v" + target.String()
+			targetV := upstreamModVersion(goMod.Upstream, target)
 			if targetSHA != "" {
 				targetV = targetSHA
 			}
@@ -258,11 +509,25 @@ func UpgradeProviderVersion(
 					target.Major())
 			}
 
-			return step.Cmd(exec.CommandContext(ctx,
-				"go", "get", upstreamPath+"@"+targetV))
+			return step.Cmd(goCmd(ctx, "get", upstreamPath+"@"+targetV))
 		}).In(&goModDir))
 	}
 
+	// Composite providers reference additional upstreams next to the primary upstream.
+	for i, name := range sortedKeys(ctx.AdditionalUpstreams) {
+		upstream := goMod.AdditionalUpstreams[i]
+		target := ctx.AdditionalUpstreams[name]
+		var sha string
+		steps = append(steps, step.Combined("Update "+name,
+			step.F("Lookup Tag SHA", func() (string, error) {
+				return lookupAdditionalUpstreamSHA(ctx, upstream, target)
+			}).AssignTo(&sha),
+			step.Computed(func() step.Step {
+				return step.Cmd(goCmd(ctx, "get", upstream.Path+"@"+sha))
+			}),
+		).In(&goModDir))
+	}
+
 	if goMod.Kind.IsForked() {
 		// If we are running a forked update, we need to replace the reference to the fork
 		// with the SHA of the new upstream branch.
@@ -284,43 +549,71 @@ func UpgradeProviderVersion(
 	if goMod.Kind.IsShimmed() {
 		// When shimmed, we also run `go mod tidy` in the shim directory, and we want to
 		// run that before running `go mod tidy` in the main `provider` directory.
-		steps = append(steps, step.Cmd(exec.CommandContext(ctx,
-			"go", "mod", "tidy")).In(&goModDir))
+		steps = append(steps, step.Cmd(goCmd(ctx, "mod", "tidy")).In(&goModDir))
 	}
 
+	// If we updated the pinned plugin sdk, then we need to run `go mod tidy` to
+	// normalize the ref. The provider module depends on the shim module, so we only
+	// tidy it once the upstream has been updated everywhere.
+	steps = append(steps, step.Computed(func() step.Step {
+		if !(*didUpdate) {
+			return nil
+		}
+		return step.Cmd(goCmd(ctx, "mod", "tidy")).
+			In(repo.providerDir())
+	}))
+
 	return step.Combined("Update TF Provider", steps...)
 }
 
 func InformGitHub(
 	ctx Context, target *UpstreamUpgradeTarget, repo ProviderRepo,
-	goMod *GoMod, targetBridgeVersion, tfSDKUpgrade string,
+	goMod *GoMod, targetBridgeVersion, tfSDKUpgrade string, breaking *[]string,
 ) step.Step {
 	pushBranch := step.Cmd(exec.CommandContext(ctx, "git", "push", "--set-upstream",
 		"origin", repo.workingBranch)).In(&repo.root)
 
-	var prTitle string
-	if ctx.UpgradeProviderVersion {
-		prTitle = fmt.Sprintf("Upgrade %s to v%s",
-			ctx.UpstreamProviderName, target.Version)
-	} else if ctx.UpgradeBridgeVersion {
-		prTitle = "Upgrade pulumi-terraform-bridge to " + targetBridgeVersion
-	} else if ctx.UpgradeCodeMigration {
-		prTitle = fmt.Sprintf("Code migration: %s", strings.Join(ctx.MigrationOpts, ", "))
-	} else {
-		panic("Unknown action")
-	}
+	prTitle := upgradeTitle(ctx, target, targetBridgeVersion)
 
-	createPR := step.Cmd(exec.CommandContext(ctx, "gh", "pr", "create",
-		"--assignee", "@me",
-		"--base", repo.defaultBranch,
-		"--head", repo.workingBranch,
-		"--reviewer", ctx.PrReviewers,
-		"--title", prTitle,
-		"--body", prBody(ctx, repo, target, goMod, targetBridgeVersion, tfSDKUpgrade),
-	)).In(&repo.root)
+	// We compute the PR when it is created, so it reflects the steps that were skipped.
+	createPR := step.Computed(func() step.Step {
+		todo := followUps(ctx)
+		// The diff only makes the PR easier to review, so we don't fail without it.
+		diff, err := goModDiff(ctx, repo, goMod)
+		if err != nil {
+			fmt.Println(colorize.Display(colorize.Warn("could not diff go.mod: " + err.Error())))
+		}
+		args := []string{"pr", "create",
+			"--assignee", ctx.prAssignee(),
+			"--base", repo.defaultBranch,
+			"--head", repo.workingBranch,
+			"--reviewer", ctx.PrReviewers,
+			"--title", prTitle,
+			"--body", prBody(ctx, repo, target, goMod, targetBridgeVersion, tfSDKUpgrade, diff, todo),
+		}
+		for _, label := range ctx.PrLabels {
+			args = append(args, "--label", label)
+		}
+		if ctx.PrMilestone != "" {
+			args = append(args, "--milestone", ctx.PrMilestone)
+		}
+		// An upgrade that needs manual follow-up is not ready for review.
+		if ctx.Draft || len(todo) > 0 {
+			args = append(args, "--draft")
+		}
+		return step.Cmd(exec.CommandContext(ctx, "gh", args...))
+	}).In(&repo.root)
 	return step.Combined("GitHub",
+		checkFreshBase(ctx, repo),
 		pushBranch,
+		verifyRemoteBranch(ctx, repo),
 		createPR,
+		step.Computed(func() step.Step {
+			if len(*breaking) == 0 {
+				return nil
+			}
+			return LabelBreakingChange(ctx, repo)
+		}),
 		step.Computed(func() step.Step {
 			// If we are only upgrading the bridge, we wont have a list of
 			// issues.
@@ -328,19 +621,161 @@ func InformGitHub(
 				return nil
 			}
 
-			// This PR will close issues, so we assign the issues to @me, just like
+			// This PR will close issues, so we assign the issues to the assignee of
 			// the PR itself.
 			issues := make([]step.Step, len(target.GHIssues))
 			for i, t := range target.GHIssues {
 				issues[i] = step.Cmd(exec.CommandContext(ctx,
 					"gh", "issue", "edit", fmt.Sprintf("%d", t.Number),
-					"--add-assignee", "@me")).In(&repo.root)
+					"--add-assignee", ctx.prAssignee())).In(&repo.root)
 			}
 			return step.Combined("Self Assign Issues", issues...)
 		}),
+		WaitForChecks(ctx, repo),
 	)
 }
 
+// How often WaitForChecks polls the checks of the PR.
+var checksPollInterval = 30 * time.Second
+
+// A check of a PR, as listed by `gh pr checks --json`.
+type prCheck struct {
+	Name string `json:"name"`
+	// One of pass, fail, pending, skipping or cancel.
+	Bucket string `json:"bucket"`
+}
+
+// Wait for the required checks of the upgrade PR to complete, by polling `gh pr checks`.
+//
+// The step fails if a required check fails, or if checks are still pending after
+// ctx.ChecksTimeout.
+func WaitForChecks(ctx Context, repo ProviderRepo) step.Step {
+	if !ctx.WaitForChecks {
+		return nil
+	}
+	return step.F("Wait For Checks", func() (string, error) {
+		deadline := time.Now().Add(ctx.ChecksTimeout)
+		for {
+			checks, err := requiredPRChecks(ctx, repo.workingBranch)
+			if err != nil {
+				return "", err
+			}
+			pending, failed := summarizeChecks(checks)
+			switch {
+			case len(failed) > 0:
+				return "", fmt.Errorf("required checks failed: %s", strings.Join(failed, ", "))
+			case len(checks) > 0 && len(pending) == 0:
+				return fmt.Sprintf("%d required checks passed", len(checks)), nil
+			case time.Now().After(deadline):
+				if len(checks) == 0 {
+					return "", fmt.Errorf("no required checks were reported after %s", ctx.ChecksTimeout)
+				}
+				return "", fmt.Errorf("timed out after %s waiting for %s",
+					ctx.ChecksTimeout, strings.Join(pending, ", "))
+			}
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(checksPollInterval):
+			}
+		}
+	}).In(&repo.root)
+}
+
+// The required checks of the PR of branch. Checks that were not reported yet, as happens
+// right after the PR is opened, are not listed.
+func requiredPRChecks(ctx Context, branch string) ([]prCheck, error) {
+	out, err := traced(exec.CommandContext(ctx, "gh", "pr", "checks", branch,
+		"--required", "--json", "name,bucket")).Output()
+	// gh exits with an error while checks are pending or failed, but still lists them.
+	if err != nil && len(bytes.TrimSpace(out)) == 0 {
+		var stderr []byte
+		if exit, ok := err.(*exec.ExitError); ok {
+			stderr = exit.Stderr
+		}
+		// gh also fails when no required checks were reported yet.
+		if bytes.Contains(stderr, []byte("no required checks reported")) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("gh pr checks: %w:\n%s", err, string(stderr))
+	}
+	var checks []prCheck
+	if err := json.Unmarshal(out, &checks); err != nil {
+		return nil, fmt.Errorf("gh pr checks: %w", err)
+	}
+	return checks, nil
+}
+
+// The names of the pending and failed checks.
+func summarizeChecks(checks []prCheck) (pending, failed []string) {
+	for _, c := range checks {
+		switch c.Bucket {
+		case "pending":
+			pending = append(pending, c.Name)
+		case "fail", "cancel":
+			failed = append(failed, c.Name)
+		}
+	}
+	return pending, failed
+}
+
+// Check that the remote default branch has not moved since repo.baseSHA was recorded.
+//
+// If it has, the upgrade is based on a stale commit. We warn, or fail if
+// ctx.RequireFreshBase is set.
+func checkFreshBase(ctx Context, repo ProviderRepo) step.Step {
+	return step.F("Check Base Is Fresh", func() (string, error) {
+		remote, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			sha, _, found := strings.Cut(strings.TrimSpace(string(b)), "\t")
+			if !found {
+				return "", fmt.Errorf("could not find remote branch '%s'", repo.defaultBranch)
+			}
+			return sha, nil
+		}, "ls-remote", "origin", "refs/heads/"+repo.defaultBranch)
+		if err != nil {
+			return "", err
+		}
+		if remote == repo.baseSHA {
+			return "up to date with origin/" + repo.defaultBranch, nil
+		}
+		msg := fmt.Sprintf("origin/%s moved from %s to %s since the upgrade started",
+			repo.defaultBranch, repo.baseSHA, remote)
+		if ctx.RequireFreshBase {
+			return "", fmt.Errorf("%s: rebase the upgrade branch and retry", msg)
+		}
+		return colorize.Warn(msg), nil
+	}).In(&repo.root)
+}
+
+// Check that repo.workingBranch exists on origin at the local HEAD commit.
+//
+// A push can be rejected by a server-side hook without git exiting with an error.
+func verifyRemoteBranch(ctx Context, repo ProviderRepo) step.Step {
+	return step.F("Verify Remote Branch", func() (string, error) {
+		remote, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			sha, _, _ := strings.Cut(strings.TrimSpace(string(b)), "\t")
+			return sha, nil
+		}, "ls-remote", "origin", "refs/heads/"+repo.workingBranch)
+		if err != nil {
+			return "", err
+		}
+		if remote == "" {
+			return "", fmt.Errorf("branch '%s' not found on origin after push", repo.workingBranch)
+		}
+		local, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			return strings.TrimSpace(string(b)), nil
+		}, "rev-parse", "HEAD")
+		if err != nil {
+			return "", err
+		}
+		if remote != local {
+			return "", fmt.Errorf("origin/%s is at %s, expected %s",
+				repo.workingBranch, remote, local)
+		}
+		return "origin/" + repo.workingBranch + " at " + remote, nil
+	}).In(&repo.root)
+}
+
 // Most if not all of our TF SDK based providers use a "replace" based version of
 // github.com/hashicorp/terraform-plugin-sdk/v2. To avoid compile errors, we want
 // to be using the most up to date version of this plugin.
@@ -396,8 +831,8 @@ func getLatestTFPluginSDKReplace(ctx context.Context, repo ProviderRepo) (step.S
 			// If the fork is present, we need to figure out the SHA of the
 			// latest upstream version to use.
 			const hostRepo = "https://github.com/pulumi/terraform-plugin-sdk.git"
-			result, err := exec.CommandContext(ctx, "git",
-				"ls-remote", "--heads", hostRepo).Output()
+			result, err := traced(exec.CommandContext(ctx, "git",
+				"ls-remote", "--heads", hostRepo)).Output()
 			if err != nil {
 				return "", fmt.Errorf("could not get branches: %w", err)
 			}
@@ -435,7 +870,7 @@ func getLatestTFPluginSDKReplace(ctx context.Context, repo ProviderRepo) (step.S
 			// If the pseudo version matches the latest SHA, we are already up
 			// to date. We don't need to do any edits.
 			if strings.HasPrefix(shas[highest], pseudo) {
-				return "already up to date", nil
+				return "", step.Skipf("already up to date")
 			}
 
 			// Otherwise, we need to replace the old version. goMod.AddReplace
@@ -459,52 +894,902 @@ func getLatestTFPluginSDKReplace(ctx context.Context, repo ProviderRepo) (step.S
 	}).In(repo.providerDir()), didReplace
 }
 
-func EnsureBranchCheckedOut(ctx Context, branchName string) step.Step {
-	var branches string
+// Check out branchName, creating it from base if it doesn't exist yet. If base is empty,
+// the branch is created from the current commit.
+//
+// The checkout may start on a detached HEAD, as ephemeral CI checkouts often do.
+func EnsureBranchCheckedOut(ctx Context, branchName, base string) step.Step {
+	var current string
 	var alreadyExists bool
-	var alreadyCurrent bool
 	return step.Combined("Ensure Branch",
-		step.Cmd(exec.CommandContext(ctx, "git", "branch")).AssignTo(&branches),
+		step.F("Current Branch", func() (string, error) {
+			// symbolic-ref fails if HEAD is detached, which leaves current empty.
+			current, _ = runGitCommand(ctx, func(b []byte) (string, error) {
+				return strings.TrimSpace(string(b)), nil
+			}, "symbolic-ref", "--quiet", "--short", "HEAD")
+			if current == "" {
+				return "detached HEAD", nil
+			}
+			return current, nil
+		}),
 		step.F("Already exists", func() (string, error) {
-			lines := strings.Split(branches, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if line == branchName {
-					alreadyExists = true
-					return "yes", nil
-				}
-				if line == "* "+branchName {
-					alreadyCurrent = true
-					return "yes, current branch", nil
-				}
+			if current == branchName {
+				return "yes, current branch", nil
+			}
+			_, err := runGitCommand[any](ctx, nil,
+				"rev-parse", "--verify", "--quiet", "refs/heads/"+branchName)
+			alreadyExists = err == nil
+			if alreadyExists {
+				return "yes", nil
 			}
 			return "no", nil
 		}),
-
 		step.Computed(func() step.Step {
-			if alreadyExists || alreadyCurrent {
+			switch {
+			case current == branchName:
 				return nil
+			case alreadyExists:
+				return step.Cmd(exec.CommandContext(ctx, "git", "checkout", branchName))
+			case base == "":
+				return step.Cmd(exec.CommandContext(ctx, "git", "checkout", "-b", branchName))
+			default:
+				return step.Cmd(exec.CommandContext(ctx, "git", "checkout", "-b", branchName, base))
 			}
-			return step.Cmd(exec.CommandContext(ctx, "git", "checkout", "-b", branchName))
+		}),
+	)
+}
+
+// Check that the Makefile in the current directory defines each target, without running
+// any of them.
+func ValidateMakeTargets(ctx Context, targets ...string) step.Step {
+	var found map[string]bool
+	steps := []step.Step{step.F("Makefile Targets", func() (string, error) {
+		var err error
+		found, err = makefileTargets(ctx)
+		return "", err
+	})}
+	for _, target := range targets {
+		target := target
+		steps = append(steps, step.F(target, func() (string, error) {
+			if !found[target] {
+				return "", fmt.Errorf("Makefile has no '%s' target", target)
+			}
+			return "found", nil
+		}))
+	}
+	return step.Combined("Validate Makefile Targets", steps...)
+}
+
+// Delete the remote branches left behind by previous upgrades to the versions the provider
+// is already at, such as when their PR was merged without deleting the branch.
+func DeleteStaleBranches(ctx Context, repo ProviderRepo, goMod *GoMod) step.Step {
+	var branches []string
+	return step.Combined("Delete Stale Remote Branches",
+		step.F("Stale Branches", func() (string, error) {
+			if repo.currentUpstreamVersion == nil {
+				// The current version is only needed to name the branch, so we
+				// don't fail without it.
+				if err := setCurrentUpstream(ctx, &repo, goMod); err != nil {
+					return colorize.Warn("unknown upstream version: " + err.Error()), nil
+				}
+			}
+			major, err := providerMajor(repo)
+			if err != nil {
+				return "", err
+			}
+			candidates := []string{bridgeUpgradeBranch(ctx, goMod.Bridge.Version, major)}
+			if repo.currentUpstreamVersion != nil {
+				candidates = append(candidates,
+					providerUpgradeBranch(ctx, repo.currentUpstreamVersion, major))
+			}
+			args := append([]string{"ls-remote", "--heads", "origin"}, candidates...)
+			branches, err = runGitCommand(ctx, func(b []byte) ([]string, error) {
+				var found []string
+				for _, line := range strings.Split(string(b), "\n") {
+					if _, ref, ok := strings.Cut(strings.TrimSpace(line), "\t"); ok {
+						found = append(found, strings.TrimPrefix(ref, "refs/heads/"))
+					}
+				}
+				return found, nil
+			}, args...)
+			if err != nil {
+				return "", err
+			}
+			if len(branches) == 0 {
+				return "none", nil
+			}
+			return strings.Join(branches, ", "), nil
 		}),
 		step.Computed(func() step.Step {
-			if alreadyCurrent {
+			if len(branches) == 0 {
 				return nil
 			}
-			return step.Cmd(exec.CommandContext(ctx, "git", "checkout", branchName))
+			return step.Cmd(exec.CommandContext(ctx, "git",
+				append([]string{"push", "origin", "--delete"}, branches...)...))
 		}),
-	)
+	).In(&repo.root)
+}
+
+// Find an upgrade of the provider within ctx.SkipIfUpgradedWithin, and assign it to found.
+func RecentUpgrade(ctx Context, repo *ProviderRepo, found *string) step.Step {
+	return step.F("Recent Upgrade", func() (string, error) {
+		since := time.Now().Add(-ctx.SkipIfUpgradedWithin)
+		upgrade, err := findRecentUpgrade(ctx, repo.defaultBranch, since)
+		if err != nil {
+			return "", err
+		}
+		if upgrade == "" {
+			return fmt.Sprintf("none within %s", ctx.SkipIfUpgradedWithin), nil
+		}
+		*found = upgrade
+		return upgrade, nil
+	}).In(&repo.root)
+}
+
+// Find an upgrade of the upstream provider or the bridge since since: a commit on branch
+// with the subject of an upgrade, or an upgrade branch of origin with a commit since then.
+//
+// An empty result means there was no recent upgrade.
+func findRecentUpgrade(ctx Context, branch string, since time.Time) (string, error) {
+	subject := regexp.MustCompile(`(?i)\bupgrade (` + regexp.QuoteMeta(ctx.UpstreamProviderName) +
+		`|pulumi-terraform-bridge) to v?[0-9]`)
+	commit, err := runGitCommand(ctx, func(b []byte) (string, error) {
+		for _, line := range strings.Split(string(b), "\n") {
+			if subject.MatchString(line) {
+				return "commit " + strings.TrimSpace(line), nil
+			}
+		}
+		return "", nil
+	}, "log", branch, "--since="+since.Format(time.RFC3339), "--format=%h %s")
+	if err != nil || commit != "" {
+		return commit, err
+	}
+
+	branches := []*regexp.Regexp{
+		upgradeBranchPattern(ctx, ctx.UpstreamProviderName),
+		upgradeBranchPattern(ctx, "pulumi-terraform-bridge"),
+	}
+	return runGitCommand(ctx, func(b []byte) (string, error) {
+		for _, line := range strings.Split(string(b), "\n") {
+			date, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+			if !ok {
+				continue
+			}
+			unix, err := strconv.ParseInt(date, 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("branch %s: invalid commit date %q", name, date)
+			}
+			if time.Unix(unix, 0).Before(since) {
+				continue
+			}
+			for _, pattern := range branches {
+				if pattern.MatchString(name) {
+					return "branch " + name, nil
+				}
+			}
+		}
+		return "", nil
+	}, "for-each-ref", "--format=%(committerdate:unix) %(refname:lstrip=3)", "refs/remotes/origin/")
+}
+
+// Check that a key is configured to sign commits with, so that a missing key fails the
+// upgrade before we make any changes instead of at the first commit.
+func CheckSigningKey(ctx Context) step.Step {
+	return step.F("Commit Signing Key", func() (string, error) {
+		if !ctx.SignCommits {
+			return "not signing", nil
+		}
+		if ctx.SigningKey != "" {
+			return ctx.SigningKey, nil
+		}
+		// `git config --get` fails if the key is not set.
+		key, _ := runGitCommand(ctx, func(b []byte) (string, error) {
+			return strings.TrimSpace(string(b)), nil
+		}, "config", "--get", "user.signingkey")
+		if key == "" {
+			return "", fmt.Errorf("no signing key configured: " +
+				"set git's user.signingkey or pass --signing-key")
+		}
+		return key, nil
+	})
+}
+
+// Check that the gh token has the scopes needed by the upgrade, so that a missing scope
+// fails the upgrade before we make any changes instead of when we open the PR.
+//
+// Fine-grained tokens don't report their scopes, so they are not checked. Neither are the
+// scopes of runs that only plan the upgrade, since they don't push anything.
+func CheckTokenScopes(ctx Context) step.Step {
+	return step.F("GitHub Token Scopes", func() (string, error) {
+		out, err := traced(exec.CommandContext(ctx, "gh", "auth", "status", "--hostname", "github.com")).
+			CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("gh is not authenticated, run `gh auth login`:\n%s", string(out))
+		}
+		if ctx.PrintSteps || ctx.PlanFile != "" {
+			return "", step.Skipf("nothing is pushed when planning")
+		}
+		scopes, ok := parseTokenScopes(string(out))
+		if !ok {
+			return "scopes not reported", nil
+		}
+		// Pushing, opening PRs and editing issues need `repo`. Major version bumps
+		// also edit GitHub workflows.
+		required := []string{"repo"}
+		if ctx.MajorVersionBump {
+			required = append(required, "workflow")
+		}
+		var missing []string
+		for _, scope := range required {
+			if !scopes[scope] {
+				missing = append(missing, scope)
+			}
+		}
+		if len(missing) > 0 {
+			return "", fmt.Errorf("the gh token is missing the scopes %s, "+
+				"add them with `gh auth refresh --scopes %s`",
+				strings.Join(missing, ", "), strings.Join(missing, ","))
+		}
+		return strings.Join(required, ", "), nil
+	})
+}
+
+// Start the built provider plugin and check that it serves a schema, which catches
+// providers that compile but fail when they start.
+//
+// The plugin binary is the one built into the bin directory of the repo, or if there is
+// none, the one found on PATH.
+func VerifyPlugin(ctx Context, repo ProviderRepo) step.Step {
+	binary := "pulumi-resource-" + strings.TrimPrefix(repo.name, "pulumi-")
+	return step.F("Verify Plugin", func() (string, error) {
+		path := filepath.Join(repo.root, "bin", binary)
+		if _, err := os.Stat(path); err != nil {
+			path, err = exec.LookPath(binary)
+			if err != nil {
+				return "", fmt.Errorf("%s was not built into bin/ and is not on PATH: %w", binary, err)
+			}
+		}
+		out, err := traced(exec.CommandContext(ctx, "pulumi", "package", "get-schema", path)).Output()
+		if err != nil {
+			if exit, ok := err.(*exec.ExitError); ok {
+				err = fmt.Errorf("%w:\n%s", err, string(exit.Stderr))
+			}
+			return "", fmt.Errorf("%s failed to serve its schema: %w", path, err)
+		}
+		var schema struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(out, &schema); err != nil {
+			return "", fmt.Errorf("%s served an invalid schema: %w", path, err)
+		}
+		if schema.Name == "" {
+			return "", fmt.Errorf("%s served a schema without a name", path)
+		}
+		if schema.Version == "" {
+			return "", fmt.Errorf("%s served a schema without a version", path)
+		}
+		return schema.Name + " " + schema.Version, nil
+	})
+}
+
+// Makefiles generated by pulumi/ci-mgmt start with a comment linking to ci-mgmt.
+func isCIMgmtMakefile(root string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(root, "Makefile"))
+	if err != nil {
+		return false, err
+	}
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	return bytes.HasPrefix(header, []byte("#")) &&
+		bytes.Contains(header, []byte("github.com/pulumi/ci-mgmt")), nil
+}
+
+// Run `make target` in the repository root.
+//
+// The targets of Makefiles generated by pulumi/ci-mgmt assume a setup that fails
+// cryptically when it is missing, so we point failures at the likely cause.
+//
+// `make tfgen` is retried once after installing any plugin it reports missing.
+func MakeTarget(ctx Context, repo ProviderRepo, target string) step.Step {
+	return runMake(ctx, repo, target)
+}
+
+// Run `make args...` in the provider repo, such as `make -j2 build_go build_nodejs`.
+func runMake(ctx Context, repo ProviderRepo, args ...string) step.Step {
+	var tfgen bool
+	for _, arg := range args {
+		tfgen = tfgen || arg == "tfgen"
+	}
+	if !repo.ciMgmt && !ctx.repairsGoModules() && !tfgen {
+		return step.Cmd(makeCmd(ctx, args...)).In(&repo.root)
+	}
+	name := "make " + strings.Join(args, " ")
+	return step.FOutput(name, func(output *string) (string, error) {
+		out, err := runRepairing(ctx, repo, func() *exec.Cmd { return makeCmd(ctx, args...) })
+		*output = string(out)
+		if err != nil && repo.ciMgmt {
+			return "", fmt.Errorf("%s: %w:\n%s\n"+
+				"The Makefile is generated by pulumi/ci-mgmt. Check that the tools it pins "+
+				"are installed, and that it was regenerated from an up to date .ci-mgmt.yaml.",
+				name, err, string(out))
+		} else if err != nil {
+			return "", fmt.Errorf("%s: %w:\n%s", name, err, string(out))
+		}
+		return "", nil
+	}).In(&repo.root)
+}
+
+// Regenerate the example programs of the provider from the upgraded schema with
+// `make ctx.ExamplesTarget`. A Makefile without the target is a warning, not a failure.
+func RegenerateExamples(ctx Context, repo ProviderRepo) step.Step {
+	target := ctx.ExamplesTarget
+	return step.Computed(func() step.Step {
+		found, err := hasMakeTarget(ctx, target)
+		if err != nil {
+			return step.F("make "+target, func() (string, error) { return "", err })
+		}
+		if !found {
+			return step.F("make "+target, func() (string, error) {
+				return "", step.Skipf("%s", colorize.Warn(
+					fmt.Sprintf("Makefile has no '%s' target", target)))
+			})
+		}
+		return MakeTarget(ctx, repo, target)
+	}).In(&repo.root)
+}
+
+// Build the SDKs of the provider: all of them with `make build_sdks`, or only
+// ctx.SDKLanguages with `make build_{language}`.
+//
+// If ctx.MaxParallelSDKs is above one, the languages are built by a single
+// `make -j{ctx.MaxParallelSDKs} build_{language}...`, so that make builds the prerequisites
+// shared by the languages once. Makefiles that only have a `build_sdks` target build it
+// instead.
+func BuildSDKs(ctx Context, repo ProviderRepo) step.Step {
+	if ctx.MaxParallelSDKs > 1 {
+		return step.Computed(func() step.Step {
+			return buildSDKsInParallel(ctx, repo)
+		}).In(&repo.root)
+	}
+	targets := ctx.sdkBuildTargets()
+	if len(targets) == 1 {
+		return MakeTarget(ctx, repo, targets[0])
+	}
+	steps := make([]step.Step, len(targets))
+	for i, target := range targets {
+		steps[i] = MakeTarget(ctx, repo, target)
+	}
+	return step.Combined("Build SDKs", steps...)
+}
+
+func buildSDKsInParallel(ctx Context, repo ProviderRepo) step.Step {
+	targets := ctx.sdkBuildTargets()
+	if len(ctx.SDKLanguages) == 0 {
+		languages, err := detectSDKLanguages(repo.root)
+		if err != nil {
+			return step.F("Build SDKs", func() (string, error) { return "", err })
+		}
+		if len(languages) <= 1 {
+			return MakeTarget(ctx, repo, "build_sdks")
+		}
+		found, err := makefileTargets(ctx)
+		if err != nil {
+			return step.F("Build SDKs", func() (string, error) { return "", err })
+		}
+		targets = nil
+		for _, lang := range languages {
+			if !found["build_"+lang] {
+				return MakeTarget(ctx, repo, "build_sdks")
+			}
+			targets = append(targets, "build_"+lang)
+		}
+	}
+	if len(targets) == 1 {
+		return MakeTarget(ctx, repo, targets[0])
+	}
+	return runMake(ctx, repo, append([]string{"-j" + strconv.Itoa(ctx.MaxParallelSDKs)}, targets...)...)
+}
+
+// A goal that no Makefile defines, so that make reads the Makefile without running a recipe.
+const noMakeGoal = ".upgrade-provider-no-such-goal"
+
+// The targets of the Makefile in the current directory.
+//
+// The targets are read from the database printed by `make -p`, for a goal that doesn't
+// exist. Unlike `make -n` or `make -q`, which still run recipe lines that use $(MAKE) or
+// start with +, no recipe is run.
+func makefileTargets(ctx Context) (map[string]bool, error) {
+	cmd := traced(makeCmd(ctx, "-pq", noMakeGoal))
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	// The goal doesn't exist, so make always fails after printing the database.
+	out, _ := cmd.Output()
+	if !bytes.Contains(out, []byte("# Make data base")) {
+		return nil, fmt.Errorf("make -p: could not read the Makefile:\n%s", stderr.String())
+	}
+	return parseMakeDatabase(out), nil
+}
+
+var makeRule = regexp.MustCompile(`^([^#\s:=][^\s:=]*)::?(?:[^=]|$)`)
+
+// The targets of a database printed by `make -p`. Files that make only considered, such as
+// the Makefile itself, are marked "# Not a target:" and are left out.
+func parseMakeDatabase(db []byte) map[string]bool {
+	targets := map[string]bool{}
+	notTarget := false
+	for _, line := range strings.Split(string(db), "\n") {
+		if line == "# Not a target:" {
+			notTarget = true
+			continue
+		}
+		if m := makeRule.FindStringSubmatch(line); m != nil && !notTarget && m[1] != noMakeGoal {
+			targets[m[1]] = true
+		}
+		notTarget = false
+	}
+	return targets
+}
+
+// If the Makefile in the current directory has target.
+func hasMakeTarget(ctx Context, target string) (bool, error) {
+	targets, err := makefileTargets(ctx)
+	if err != nil {
+		return false, err
+	}
+	return targets[target], nil
+}
+
+// Run `go args...` in the provider directory, such as `go mod tidy`.
+//
+// Failures caused by missing go.sum entries or an insufficient go directive are repaired
+// if ctx.RepairGoSum or ctx.BumpGoDirective is set.
+func ProviderGoCmd(ctx Context, repo ProviderRepo, args ...string) step.Step {
+	if !ctx.repairsGoModules() {
+		return step.Cmd(goCmd(ctx, args...)).In(repo.providerDir())
+	}
+	name := "go " + strings.Join(args, " ")
+	return step.FOutput(name, func(output *string) (string, error) {
+		out, err := runRepairing(ctx, repo, func() *exec.Cmd { return goCmd(ctx, args...) })
+		*output = string(out)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w:\n%s", name, err, string(out))
+		}
+		return "", nil
+	}).In(repo.providerDir())
+}
+
+// The error reported by go when go.sum lacks the hash of a required module.
+const missingGoSumEntry = "missing go.sum entry"
+
+// The error reported by go when a module requires a newer go directive, such as
+// "requires go >= 1.21.0".
+var requiresGo = regexp.MustCompile(`requires go >= ([0-9]+\.[0-9]+(?:\.[0-9]+)?)`)
+
+// The go version that the output of a failed go command requires, if any.
+func requiredGoVersion(out []byte) (string, bool) {
+	m := requiresGo.FindSubmatch(out)
+	if m == nil {
+		return "", false
+	}
+	return string(m[1]), true
+}
+
+// The error reported by pulumi when a plugin it needs is not installed, such as "no
+// resource plugin 'pulumi-resource-random' found in the workspace at version v4.13.0".
+var missingPlugin = regexp.MustCompile(
+	`no (resource|language|converter|analyzer) plugin '(?:pulumi-[a-z]+-)?([^']+)' ` +
+		`found in the workspace(?: at version v?([^\s,]+))?`)
+
+// The arguments to `pulumi plugin install` for each plugin that the output of a failed
+// command reports missing.
+func missingPlugins(out []byte) [][]string {
+	var plugins [][]string
+	seen := map[string]bool{}
+	for _, m := range missingPlugin.FindAllSubmatch(out, -1) {
+		args := []string{string(m[1]), string(m[2])}
+		if len(m[3]) > 0 {
+			args = append(args, "v"+string(m[3]))
+		}
+		if key := strings.Join(args, " "); !seen[key] {
+			seen[key] = true
+			plugins = append(plugins, args)
+		}
+	}
+	return plugins
+}
+
+// Run the command made by cmd, returning its combined output.
+//
+// If the command fails, we repair the provider module and run the command once more:
+//
+//   - If ctx.RepairGoSum is set and go.sum is missing entries, as happens after `go get`
+//     across major versions, we download the modules of the provider and tidy it again.
+//   - If ctx.BumpGoDirective is set and a dependency, such as the bridge, requires a
+//     newer go directive, we raise the go directive of the provider (and of its shim) to
+//     the required version.
+//   - If pulumi reports that a plugin is missing, as happens when `make tfgen` needs a
+//     plugin removed by --remove-plugins, we install the plugin.
+func runRepairing(ctx Context, repo ProviderRepo, cmd func() *exec.Cmd) ([]byte, error) {
+	out, err := traced(cmd()).CombinedOutput()
+	if err == nil {
+		return out, nil
+	}
+	var repaired bool
+	if version, ok := requiredGoVersion(out); ok && ctx.BumpGoDirective {
+		dirs := []string{*repo.providerDir()}
+		shim := filepath.Join(*repo.providerDir(), "shim")
+		if _, err := os.Stat(filepath.Join(shim, "go.mod")); err == nil {
+			dirs = append(dirs, shim)
+		}
+		for _, dir := range dirs {
+			bump := goCmd(ctx, "mod", "edit", "-go="+version)
+			bump.Dir = dir
+			if out, err := traced(bump).CombinedOutput(); err != nil {
+				return out, fmt.Errorf("bumping the go directive of %s to %s: %w", dir, version, err)
+			}
+		}
+		repaired = true
+	}
+	if ctx.RepairGoSum && bytes.Contains(out, []byte(missingGoSumEntry)) {
+		for _, args := range [][]string{{"mod", "download"}, {"mod", "tidy"}} {
+			repair := goCmd(ctx, args...)
+			repair.Dir = *repo.providerDir()
+			if out, err := traced(repair).CombinedOutput(); err != nil {
+				return out, fmt.Errorf("repairing go.sum: go %s: %w", strings.Join(args, " "), err)
+			}
+		}
+		repaired = true
+	}
+	for _, plugin := range missingPlugins(out) {
+		install := exec.CommandContext(ctx, "pulumi", append([]string{"plugin", "install"}, plugin...)...)
+		if out, err := traced(install).CombinedOutput(); err != nil {
+			return out, fmt.Errorf("installing the %s plugin %s: %w", plugin[0], plugin[1], err)
+		}
+		repaired = true
+	}
+	if !repaired {
+		return out, err
+	}
+	return traced(cmd()).CombinedOutput()
+}
+
+// Check that the pulumi fork that provider/go.mod replaces the upstream with exists, so a
+// typo in the replace fails before anything is changed instead of when we clone or push.
+func CheckForkExists(ctx Context, goMod *GoMod) step.Step {
+	return step.F("Fork Exists", func() (string, error) {
+		if modfile.IsDirectoryPath(goMod.Fork.New.Path) {
+			return "", step.Skipf("replaced by the local directory %s", goMod.Fork.New.Path)
+		}
+		path := forkRepoPath(goMod.Fork.New.Path)
+		url, err := repoCloneURL(ctx, path)
+		if err != nil {
+			return "", fmt.Errorf("fork %s: %w", path, err)
+		}
+		if err := checkRemoteExists(ctx, url); err != nil {
+			return "", fmt.Errorf("fork %s, from the replace in provider/go.mod: %w", path, err)
+		}
+		return url, nil
+	})
+}
+
+// Check that url is a git repository we can read, without prompting for credentials.
+func checkRemoteExists(ctx context.Context, url string) error {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--quiet", url, "HEAD")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := traced(cmd).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s is not a readable git repository: %w:\n%s", url, err, string(out))
+	}
+	return nil
+}
+
+// Check that provider/go.mod requires the same upstream version as provider/shim/go.mod.
+//
+// A mismatch is a warning, or an error if ctx.Strict is set.
+func CheckShimUpstreamVersion(ctx Context, repo ProviderRepo, goMod *GoMod) step.Step {
+	return step.F("Shim Upstream Version", func() (string, error) {
+		file := filepath.Join(*repo.providerDir(), "go.mod")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		providerMod, err := modfile.Parse(file, data, nil)
+		if err != nil {
+			return "", fmt.Errorf("go.mod: %w", err)
+		}
+		for _, r := range providerMod.Require {
+			if r.Mod.Path != goMod.Upstream.Path {
+				continue
+			}
+			if r.Mod.Version == goMod.Upstream.Version {
+				return "consistent at " + r.Mod.Version, nil
+			}
+			msg := fmt.Sprintf("provider/go.mod requires %s but provider/shim/go.mod requires %s",
+				r.Mod, goMod.Upstream)
+			if ctx.Strict {
+				return "", fmt.Errorf("%s", msg)
+			}
+			return colorize.Warn(msg), nil
+		}
+		return "not required by provider/go.mod", nil
+	})
+}
+
+// Check the version of pulumi-terraform-bridge that provider/go.mod resolved to after
+// `go mod tidy`, which can move the bridge past the version we asked for when another
+// dependency requires a newer one.
+//
+// expected is the version we upgraded the bridge to, or the previous version if the
+// bridge was not upgraded. A different version is a warning, or an error if ctx.Strict
+// is set. A version that doesn't satisfy ctx.BridgeVersionConstraint is always an error.
+func CheckBridgeVersion(ctx Context, repo ProviderRepo, expected string) step.Step {
+	return step.F("Bridge Version", func() (string, error) {
+		providerMod, err := readProviderGoMod(repo)
+		if err != nil {
+			return "", err
+		}
+		resolved, ok := bridgeVersionOf(providerMod)
+		if !ok {
+			return "", fmt.Errorf("go.mod: pulumi-terraform-bridge is not required")
+		}
+		if ctx.BridgeVersionConstraint != nil {
+			v, err := semver.NewVersion(resolved)
+			if err != nil {
+				return "", fmt.Errorf("pulumi-terraform-bridge %s: %w", resolved, err)
+			}
+			if !ctx.BridgeVersionConstraint.Check(v) {
+				return "", fmt.Errorf("pulumi-terraform-bridge resolved to %s, "+
+					"which does not satisfy --bridge-version-constraint=%s",
+					resolved, ctx.BridgeVersionConstraint)
+			}
+		}
+		// A replaced bridge is pinned by the replace, which neither `go get` nor `go mod tidy`
+		// change, so there is no expected version to compare against.
+		if replace := bridgeReplaceOf(providerMod); replace != nil {
+			return fmt.Sprintf("%s (replaced by %s)", resolved, replace.New.Path), nil
+		}
+		if resolved == expected {
+			return resolved, nil
+		}
+		msg := fmt.Sprintf("pulumi-terraform-bridge resolved to %s, expected %s", resolved, expected)
+		if ctx.Strict {
+			return "", fmt.Errorf("%s", msg)
+		}
+		return colorize.Warn(msg), nil
+	})
+}
+
+// Check that pinning the pulumi SDK to sdkVersion left the bridge at bridgeVersion. `go get`
+// downgrades the bridge instead of failing when the bridge requires a newer SDK.
+func CheckPinnedSDK(ctx Context, repo ProviderRepo, bridgeVersion, sdkVersion string) step.Step {
+	return step.F("Pinned SDK", func() (string, error) {
+		providerMod, err := readProviderGoMod(repo)
+		if err != nil {
+			return "", err
+		}
+		for _, r := range providerMod.Require {
+			if modPathWithoutVersion(r.Mod.Path) != bridgeModule {
+				continue
+			}
+			if r.Mod.Version != bridgeVersion {
+				return "", fmt.Errorf("pinning the pulumi SDK to %s moved pulumi-terraform-bridge "+
+					"from %s to %s: the bridge requires a newer SDK than the compat matrix lists",
+					sdkVersion, bridgeVersion, r.Mod.Version)
+			}
+			return sdkVersion, nil
+		}
+		return "", fmt.Errorf("go.mod: pulumi-terraform-bridge is not required")
+	})
+}
+
+func readProviderGoMod(repo ProviderRepo) (*modfile.File, error) {
+	file := filepath.Join(*repo.providerDir(), "go.mod")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	providerMod, err := modfile.Parse(file, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("go.mod: %w", err)
+	}
+	return providerMod, nil
+}
+
+const bridgeModule = "github.com/pulumi/pulumi-terraform-bridge"
+
+// The version of pulumi-terraform-bridge used by file, honoring replace directives.
+func bridgeVersionOf(file *modfile.File) (string, bool) {
+	if r := bridgeReplaceOf(file); r != nil && r.New.Version != "" {
+		return r.New.Version, true
+	}
+	for _, r := range file.Require {
+		if modPathWithoutVersion(r.Mod.Path) == bridgeModule {
+			return r.Mod.Version, true
+		}
+	}
+	return "", false
+}
+
+// The replace of pulumi-terraform-bridge in file, if any.
+func bridgeReplaceOf(file *modfile.File) *modfile.Replace {
+	for _, r := range file.Replace {
+		if modPathWithoutVersion(r.Old.Path) == bridgeModule {
+			return r
+		}
+	}
+	return nil
+}
+
+// Check that `make tfgen` changed the generated schema, which it should whenever the
+// upstream provider or the bridge was upgraded. A tfgen target that regenerates nothing
+// indicates a broken codegen setup.
+//
+// A bridge upgrade can legitimately leave the schema unchanged, so ctx.Strict only fails
+// the check when the upstream provider was upgraded.
+func CheckTfgenOutput(ctx Context, repo ProviderRepo) step.Step {
+	return step.F("Check tfgen Output", func() (string, error) {
+		if !ctx.UpgradeProviderVersion && !ctx.UpgradeBridgeVersion {
+			return "no upgrade to check", nil
+		}
+		changes, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			return strings.TrimSpace(string(b)), nil
+		}, "status", "--porcelain=1", "--", filepath.Join("provider", "cmd"))
+		if err != nil {
+			return "", err
+		}
+		if changes != "" {
+			return "schema regenerated", nil
+		}
+		msg := "make tfgen did not change anything in provider/cmd despite the upgrade"
+		if ctx.Strict && ctx.UpgradeProviderVersion {
+			return "", fmt.Errorf("%s", msg)
+		}
+		return colorize.Warn(msg), nil
+	}).In(&repo.root)
+}
+
+// The label of upgrade PRs that break the schema of the provider.
+const breakingChangeLabel = "needs-release/major"
+
+// Label the upgrade PR with breakingChangeLabel, creating the label if the repo doesn't have
+// it yet. The PR was already created, so failing to label it is only a warning.
+func LabelBreakingChange(ctx Context, repo ProviderRepo) step.Step {
+	return step.F("Label Breaking Change", func() (string, error) {
+		// Creating a label that already exists fails, which is fine. We don't pass --force,
+		// which would overwrite the color and description of the existing label.
+		_ = traced(exec.CommandContext(ctx, "gh", "label", "create", breakingChangeLabel,
+			"--color", "B60205",
+			"--description", "The upgrade breaks the schema of the provider")).Run()
+		out, err := traced(exec.CommandContext(ctx, "gh", "pr", "edit", repo.workingBranch,
+			"--add-label", breakingChangeLabel)).CombinedOutput()
+		if err != nil {
+			return colorize.Warn(fmt.Sprintf("could not label the PR %s: %s:\n%s",
+				breakingChangeLabel, err, string(out))), nil
+		}
+		return breakingChangeLabel, nil
+	}).In(&repo.root)
+}
+
+// Compare the schema regenerated by `make tfgen` against the schema of the default branch,
+// and record the breaking changes in breaking. Removing resources or properties breaks
+// users of the provider, which may require a major version bump of the provider.
+func CheckBreakingChanges(ctx Context, repo ProviderRepo, breaking *[]string) step.Step {
+	if !ctx.CheckBreakingChanges {
+		return nil
+	}
+	return step.F("Check Breaking Changes", func() (string, error) {
+		path := filepath.Join("provider", "cmd",
+			"pulumi-resource-"+strings.TrimPrefix(repo.name, "pulumi-"), "schema.json")
+		before, err := baseFileAt(ctx, repo, path)
+		if err != nil {
+			return "", err
+		}
+		after, err := os.ReadFile(filepath.Join(repo.root, path))
+		if err != nil {
+			return "", err
+		}
+		changes, err := breakingSchemaChanges(before, after)
+		if err != nil {
+			return "", err
+		}
+		*breaking = changes
+		if len(changes) == 0 {
+			return "no breaking changes", nil
+		}
+		msg := fmt.Sprintf("%d breaking changes:\n  %s", len(changes), strings.Join(changes, "\n  "))
+		if !ctx.MajorVersionBump {
+			msg += "\nA major version bump of the provider may be required (--major)"
+		}
+		return colorize.Warn(msg), nil
+	})
+}
+
+// Run the user supplied post step hooks in the repository root, and commit any changes
+// they make. In squash mode, the changes are only staged.
+func PostStepHooks(ctx Context, repo ProviderRepo) step.Step {
+	if len(ctx.PostStepHooks) == 0 && len(ctx.OptionalPostStepHooks) == 0 {
+		return nil
+	}
+	var steps []step.Step
+	for _, hook := range ctx.PostStepHooks {
+		steps = append(steps, step.Cmd(exec.CommandContext(ctx, "sh", "-c", hook)))
+	}
+	for _, hook := range ctx.OptionalPostStepHooks {
+		hook := hook
+		steps = append(steps, step.F(hook+" (optional)", func() (string, error) {
+			out, err := traced(exec.CommandContext(ctx, "sh", "-c", hook)).CombinedOutput()
+			if err != nil {
+				return colorize.Warn(fmt.Sprintf("failed: %s:\n%s", err, string(out))), nil
+			}
+			return "", nil
+		}))
+	}
+	steps = append(steps, step.Cmd(exec.CommandContext(ctx, "git", "add", "--all")))
+	if ctx.CommitMode != "squash" {
+		steps = append(steps,
+			GitCommit(ctx, ctx.commitMessage("post step hooks", "", "run post step hooks"), ""))
+	}
+	return step.Combined("Post Step Hooks", steps...).In(&repo.root)
 }
 
+// Lock the provider repo at repo.root against concurrent runs of upgrade-provider, which
+// would corrupt each other's branches and commits. The lock is released by calling the
+// function assigned to release.
+//
+// The lock file is kept in the git directory of the repo, so it is never committed. It is
+// taken with tryLock, so a lock file left behind by a killed run doesn't block later runs.
+func LockRepo(ctx Context, repo *ProviderRepo, release *func()) step.Step {
+	if ctx.NoLock {
+		return nil
+	}
+	return step.F("Lock Repo", func() (string, error) {
+		gitDir, err := runGitCommand(ctx, func(b []byte) (string, error) {
+			return strings.TrimSpace(string(b)), nil
+		}, "rev-parse", "--absolute-git-dir")
+		if err != nil {
+			return "", err
+		}
+		lockFile := filepath.Join(gitDir, "upgrade-provider.lock")
+		unlock, err := tryLock(lockFile)
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			return "", fmt.Errorf("another upgrade of %s is running: %s", repo.name, locked)
+		} else if err != nil {
+			return "", err
+		}
+		*release = unlock
+		return lockFile, nil
+	}).In(&repo.root)
+}
+
+// Ensure that the provider repo org/repo is checked out.
+//
+// If ctx.ProviderRepoURL is set, the repo is cloned from it instead.
 func OrgProviderRepos(ctx Context, org, repo string) step.Step {
-	return ensureUpstreamRepo(ctx, path.Join("github.com", org, repo))
+	repoPath, err := providerRepoPath(ctx, org, repo)
+	if err != nil {
+		return step.F("Ensure '"+ctx.ProviderRepoURL+"'", func() (string, error) { return "", err })
+	}
+	return ensureRepo(ctx, repoPath, ctx.ProviderRepoURL)
 }
 
+// Find the default branch of remote, and check it out at the head of remote.
+//
+// With ctx.PrintSteps, the checkout is left alone and only the default branch is found.
 func PullDefaultBranch(ctx Context, remote string) step.Step {
 	var lsRemoteHeads string
 	var defaultBranch string
-	return step.Combined("pull default branch",
-		step.Cmd(exec.Command("git", "ls-remote", "--heads", remote)).AssignTo(&lsRemoteHeads),
+	pull := []step.Step{
+		step.Cmd(exec.CommandContext(ctx, "git", "fetch")),
+		step.Computed(func() step.Step {
+			return step.Cmd(exec.CommandContext(ctx, "git", "checkout", defaultBranch))
+		}),
+		step.Cmd(exec.CommandContext(ctx, "git", "pull", remote)),
+	}
+	if ctx.PrintSteps {
+		pull = nil
+	}
+	return step.Combined("pull default branch", append([]step.Step{
+		step.Cmd(exec.CommandContext(ctx, "git", "ls-remote", "--heads", remote)).AssignTo(&lsRemoteHeads),
 		step.F("finding default branch", func() (string, error) {
 			var hasMaster bool
 			lines := strings.Split(lsRemoteHeads, "\n")
@@ -528,12 +1813,7 @@ func PullDefaultBranch(ctx Context, remote string) step.Step {
 			}
 			return "", fmt.Errorf("could not find 'master' or 'main' branch")
 		}).AssignTo(&defaultBranch),
-		step.Cmd(exec.CommandContext(ctx, "git", "fetch")),
-		step.Computed(func() step.Step {
-			return step.Cmd(exec.CommandContext(ctx, "git", "checkout", defaultBranch))
-		}),
-		step.Cmd(exec.CommandContext(ctx, "git", "pull", remote)),
-	).Return(&defaultBranch)
+	}, pull...)...).Return(&defaultBranch)
 }
 
 func MajorVersionBump(ctx Context, goMod *GoMod, target *UpstreamUpgradeTarget, repo ProviderRepo) step.Step {
@@ -571,11 +1851,11 @@ func MajorVersionBump(ctx Context, goMod *GoMod, target *UpstreamUpgradeTarget,
 		replaceInFile("Update PROVIDER_PATH", "Makefile",
 			"PROVIDER_PATH := {}").In(&repo.root),
 		replaceInFile("Update -X Version", ".goreleaser.yml",
-			"github.com/pulumi/"+name+"/{}/pkg").In(&repo.root),
+			"github.com/"+repo.org+"/"+name+"/{}/pkg").In(&repo.root),
 		replaceInFile("Update -X Version", ".goreleaser.prerelease.yml",
-			"github.com/pulumi/"+name+"/{}/pkg").In(&repo.root),
+			"github.com/"+repo.org+"/"+name+"/{}/pkg").In(&repo.root),
 		replaceInFile("Update Go Module", "go.mod",
-			"module github.com/pulumi/"+name+"/{}").In(repo.providerDir()),
+			"module github.com/"+repo.org+"/"+name+"/{}").In(repo.providerDir()),
 		step.F("Update sdk/go.mod", func() (string, error) {
 			path := "sdk/go.mod"
 			f, err := os.ReadFile(path)
@@ -603,11 +1883,11 @@ func MajorVersionBump(ctx Context, goMod *GoMod, target *UpstreamUpgradeTarget,
 				}
 
 				new := bytes.ReplaceAll(data,
-					[]byte("github.com/pulumi/"+name+"/"+prev),
-					[]byte("github.com/pulumi/"+name+"/"+"provider/"+nextMajorVersion),
+					[]byte("github.com/"+repo.org+"/"+name+"/"+prev),
+					[]byte("github.com/"+repo.org+"/"+name+"/"+"provider/"+nextMajorVersion),
 				)
 
-				if !goMod.Kind.IsPatched() && !goMod.Kind.IsForked() {
+				if !goMod.Kind.IsPatched() && !goMod.Kind.IsForked() && goMod.Kind != Submodule {
 					if idx := versionSuffix.FindStringIndex(goMod.Upstream.Path); idx != nil {
 						newUpstream := fmt.Sprintf("%s/v%d",
 							goMod.Upstream.Path[:idx[0]],
@@ -788,13 +2068,23 @@ func migrationSteps(ctx Context, repo ProviderRepo, providerName string, descrip
 			fmt.Println(description, ", changes made: ", changesMade)
 			return "", err
 		}))
-	if changesMade {
-		steps = append(steps,
+	// Whether changes were made is only known once the migration has run.
+	steps = append(steps, step.Computed(func() step.Step {
+		if !changesMade {
+			return nil
+		}
+		// In squash mode, the changes are only staged, and committed with the rest of
+		// the upgrade.
+		var commit step.Step
+		if ctx.CommitMode != "squash" {
+			commit = step.Cmd(gitCommitCmd(ctx, "-m", description)).In(&repo.root)
+		}
+		return step.Combined("Commit "+description,
 			step.Cmd(exec.CommandContext(ctx, "gofmt", "-s", "-w", "resources.go")).In(repo.providerDir()),
 			step.Cmd(exec.CommandContext(ctx, "git", "add", "resources.go")).In(&repo.root),
-			step.Cmd(exec.CommandContext(ctx, "git", "commit", "-m", description)).In(&repo.root),
+			commit,
 		)
-	}
+	}))
 
 	return steps, nil
 }
@@ -0,0 +1,422 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+func TestUpgradeProviderVersionOrder(t *testing.T) {
+	ctx := Context{Context: context.Background()}
+	goMod := &GoMod{
+		Kind:     ForkedAndShimmed,
+		Upstream: module.Version{Path: "github.com/hashicorp/terraform-provider-aws"},
+		Fork: &modfile.Replace{
+			Old: module.Version{Path: "github.com/hashicorp/terraform-provider-aws"},
+			New: module.Version{Path: "github.com/pulumi/terraform-provider-aws"},
+		},
+	}
+	repo := ProviderRepo{root: "/repo"}
+
+	var visited []string
+	step.Plan(UpgradeProviderVersion(ctx, goMod, semver.MustParse("5.0.0"), repo,
+		"", "abc123"), func(depth int, name, dir string) {
+		visited = append(visited, fmt.Sprintf("%d %s [%s]", depth, name, dir))
+	})
+
+	// The shim is updated and tidied before the provider module that depends on it.
+	assert.Equal(t, []string{
+		"0 Update TF Provider []",
+		"1 (computed when run) [/repo/provider]",
+		"1 go mod edit -replace github.com/hashicorp/terraform-provider-aws=" +
+			"github.com/pulumi/terraform-provider-aws@abc123 [/repo/provider/shim]",
+		"1 go mod edit -replace github.com/hashicorp/terraform-provider-aws=" +
+			"github.com/pulumi/terraform-provider-aws@abc123 [/repo/provider]",
+		"1 go mod tidy [/repo/provider/shim]",
+		"1 (computed when run) []",
+	}, visited)
+}
+
+func TestIncompatibleUpstream(t *testing.T) {
+	dir := newTestRepo(t)
+	git := func(args ...string) string { return runGit(t, dir, nil, args...) }
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "provider"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "provider", "go.mod"),
+		[]byte(`module github.com/pulumi/pulumi-old/provider
+
+require github.com/example/terraform-provider-old v2.3.0+incompatible
+`), 0600))
+	git("add", ".")
+	git("commit", "--quiet", "-m", "first")
+
+	ctx := Context{Context: context.Background(), TagPrefix: "v"}
+	repo := ProviderRepo{root: dir, defaultBranch: "main"}
+	goMod := &GoMod{
+		Kind: Plain,
+		Upstream: module.Version{
+			Path:    "github.com/example/terraform-provider-old",
+			Version: "v2.3.0+incompatible",
+		},
+	}
+
+	// The current version is found without the suffix, so it compares against tags.
+	assert.NoError(t, setCurrentUpstreamFromPlain(ctx, &repo, goMod))
+	if assert.NotNil(t, repo.currentUpstreamVersion) {
+		assert.Equal(t, "2.3.0", repo.currentUpstreamVersion.String())
+	}
+
+	target := semver.MustParse("2.4.0")
+	assert.Equal(t, "v2.4.0", ctx.upstreamTag(target))
+
+	// The require keeps the suffix.
+	assert.Equal(t, "v2.4.0+incompatible", upstreamModVersion(goMod.Upstream, target))
+}
+
+func TestEnsureBranchCheckedOutDetached(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	dir := newTestRepo(t)
+	git := func(args ...string) string { return runGit(t, dir, nil, args...) }
+	git("commit", "--quiet", "--allow-empty", "-m", "first")
+	git("commit", "--quiet", "--allow-empty", "-m", "second")
+
+	ctx := Context{Context: context.Background()}
+	tests := []struct {
+		branch, base, expected string
+	}{
+		{"from-main", "main", "main"},
+		{"from-head", "", "main~1"},
+	}
+	for _, tt := range tests {
+		git("checkout", "--quiet", "--detach", "main~1")
+		ok := step.Run(EnsureBranchCheckedOut(ctx, tt.branch, tt.base).In(&dir))
+		assert.True(t, ok)
+		assert.Equal(t, tt.branch, git("symbolic-ref", "--short", "HEAD"))
+		assert.Equal(t, git("rev-parse", tt.expected), git("rev-parse", "HEAD"))
+	}
+
+	// An existing branch is checked out as is.
+	git("checkout", "--quiet", "--detach", "main")
+	ok := step.Run(EnsureBranchCheckedOut(ctx, "from-head", "main").In(&dir))
+	assert.True(t, ok)
+	assert.Equal(t, "from-head", git("symbolic-ref", "--short", "HEAD"))
+	assert.Equal(t, git("rev-parse", "main~1"), git("rev-parse", "HEAD"))
+}
+
+func TestBridgeVersionOf(t *testing.T) {
+	file, err := modfile.Parse("go.mod", []byte(`module github.com/pulumi/pulumi-foo/provider
+
+require github.com/pulumi/pulumi-terraform-bridge/v3 v3.50.0
+`), nil)
+	assert.NoError(t, err)
+	v, ok := bridgeVersionOf(file)
+	assert.True(t, ok)
+	assert.Equal(t, "v3.50.0", v)
+
+	assert.NoError(t, file.AddReplace("github.com/pulumi/pulumi-terraform-bridge/v3", "",
+		"github.com/pulumi/pulumi-terraform-bridge/v3", "v3.49.0"))
+	v, ok = bridgeVersionOf(file)
+	assert.True(t, ok)
+	assert.Equal(t, "v3.49.0", v)
+}
+
+func TestVerifyResolvedMerge(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	dir := newTestRepo(t)
+	git := func(args ...string) string { return runGit(t, dir, nil, args...) }
+	git("commit", "--quiet", "--allow-empty", "-m", "first")
+	git("checkout", "--quiet", "-b", "upstream-v1.1.0")
+	git("checkout", "--quiet", "main")
+	git("commit", "--quiet", "--allow-empty", "-m", "release")
+	git("tag", "v1.1.0")
+	git("checkout", "--quiet", "upstream-v1.1.0")
+
+	ctx := Context{Context: context.Background(), TagPrefix: "v"}
+	verify := verifyResolvedMerge(ctx, semver.MustParse("1.1.0")).In(&dir)
+	assert.False(t, step.Run(verify))
+
+	git("merge", "--quiet", "--no-ff", "-m", "merge", "v1.1.0")
+	assert.True(t, step.Run(verify))
+}
+
+func TestSummarizeChecks(t *testing.T) {
+	pending, failed := summarizeChecks([]prCheck{
+		{Name: "lint", Bucket: "pass"},
+		{Name: "test", Bucket: "pending"},
+		{Name: "build", Bucket: "fail"},
+		{Name: "docs", Bucket: "skipping"},
+		{Name: "release", Bucket: "cancel"},
+	})
+	assert.Equal(t, []string{"test"}, pending)
+	assert.Equal(t, []string{"build", "release"}, failed)
+
+	pending, failed = summarizeChecks(nil)
+	assert.Empty(t, pending)
+	assert.Empty(t, failed)
+}
+
+func TestRunRepairingGoDirective(t *testing.T) {
+	root := t.TempDir()
+	providerDir := filepath.Join(root, "provider")
+	assert.NoError(t, os.MkdirAll(providerDir, 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(providerDir, "go.mod"),
+		[]byte("module github.com/pulumi/pulumi-foo/provider\n\ngo 1.18\n"), 0600))
+
+	// Fails until the go directive is raised.
+	build := func() *exec.Cmd {
+		cmd := exec.Command("sh", "-c", `grep -q "^go 1.21$" go.mod || {
+  echo "go: github.com/pulumi/pulumi-terraform-bridge/v3@v3.60.0 requires go >= 1.21 (running go 1.20)"
+  exit 1
+}`)
+		cmd.Dir = providerDir
+		return cmd
+	}
+	repo := ProviderRepo{root: root}
+
+	ctx := Context{Context: context.Background()}
+	_, err := runRepairing(ctx, repo, build)
+	assert.Error(t, err)
+
+	ctx.BumpGoDirective = true
+	out, err := runRepairing(ctx, repo, build)
+	assert.NoError(t, err, string(out))
+	data, err := os.ReadFile(filepath.Join(providerDir, "go.mod"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "go 1.21\n")
+}
+
+func TestLockRepo(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	dir := newTestRepo(t)
+
+	// A run that was killed leaves its lock file behind, which doesn't hold the lock.
+	lockFile := filepath.Join(dir, ".git", "upgrade-provider.lock")
+	assert.NoError(t, os.WriteFile(lockFile, []byte("99999999\n"), 0600))
+
+	ctx := Context{Context: context.Background()}
+	repo := ProviderRepo{root: dir, name: "pulumi-foo"}
+	var release, other func()
+	assert.True(t, step.Run(LockRepo(ctx, &repo, &release)))
+	if assert.NotNil(t, release) {
+		// A second run fails fast while the lock is held.
+		assert.False(t, step.Run(LockRepo(ctx, &repo, &other)))
+		if assert.NotNil(t, step.LastFailure()) {
+			assert.ErrorContains(t, step.LastFailure().Err, "another upgrade of pulumi-foo is running")
+			assert.ErrorContains(t, step.LastFailure().Err, fmt.Sprintf("held by pid %d", os.Getpid()))
+		}
+		release()
+	}
+	assert.True(t, step.Run(LockRepo(ctx, &repo, &other)))
+	other()
+
+	ctx.NoLock = true
+	assert.Nil(t, LockRepo(ctx, &repo, &other))
+}
+
+func TestEnsureCleanUpstream(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	dir := newTestRepo(t)
+	git := func(args ...string) string { return runGit(t, dir, nil, args...) }
+	write := func(content string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte(content), 0600))
+	}
+	write("base\n")
+	git("add", "file")
+	git("commit", "--quiet", "-m", "base")
+	git("checkout", "--quiet", "-b", "other")
+	write("other\n")
+	git("commit", "--quiet", "-am", "other")
+	git("checkout", "--quiet", "main")
+	write("main\n")
+	git("commit", "--quiet", "-am", "main")
+
+	ctx := Context{Context: context.Background()}
+	clean := ensureCleanUpstream(ctx).In(&dir)
+	assert.True(t, step.Run(clean))
+
+	// An interrupted merge leaves conflicts behind.
+	_, err := tryGit(dir, nil, "merge", "other")
+	assert.Error(t, err)
+	assert.NotEmpty(t, git("status", "--porcelain", "--untracked-files=no"))
+	assert.False(t, step.Run(clean))
+
+	ctx.ResetUpstream = true
+	assert.True(t, step.Run(ensureCleanUpstream(ctx).In(&dir)))
+	assert.Empty(t, git("status", "--porcelain", "--untracked-files=no"))
+	_, err = tryGit(dir, nil, "rev-parse", "--verify", "--quiet", "MERGE_HEAD")
+	assert.Error(t, err)
+}
+
+func TestMissingPlugins(t *testing.T) {
+	out := []byte(`error: could not load schema: no resource plugin 'pulumi-resource-random' found in the workspace at version v4.13.0 or on your $PATH, install the plugin using ` + "`pulumi plugin install resource random v4.13.0`" + `
+error: no resource plugin 'pulumi-resource-random' found in the workspace at version v4.13.0 or on your $PATH
+error: no converter plugin 'terraform' found in the workspace
+`)
+	assert.Equal(t, [][]string{
+		{"resource", "random", "v4.13.0"},
+		{"converter", "terraform"},
+	}, missingPlugins(out))
+
+	assert.Empty(t, missingPlugins([]byte("error: make: *** [tfgen] Error 1")))
+}
+
+func TestCheckRemoteExists(t *testing.T) {
+	dir := newTestRepo(t)
+
+	ctx := context.Background()
+	assert.NoError(t, checkRemoteExists(ctx, dir))
+	assert.ErrorContains(t, checkRemoteExists(ctx, filepath.Join(dir, "missing")),
+		"is not a readable git repository")
+}
+
+func TestRegenerateExamples(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "Makefile"),
+		[]byte("examples:\n\ttouch regenerated\n"), 0600))
+	repo := ProviderRepo{root: root}
+
+	ctx := Context{Context: context.Background(), ExamplesTarget: "examples"}
+	assert.True(t, step.Run(RegenerateExamples(ctx, repo)))
+	assert.FileExists(t, filepath.Join(root, "regenerated"))
+
+	// A missing target doesn't fail the upgrade.
+	ctx.ExamplesTarget = "gen_examples"
+	assert.True(t, step.Run(RegenerateExamples(ctx, repo)))
+}
+
+func TestBuildSDKsInParallel(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	root := t.TempDir()
+	for _, lang := range []string{"nodejs", "python"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, "sdk", lang), 0700))
+	}
+	makefile := func(content string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "Makefile"), []byte(content), 0600))
+	}
+	repo := ProviderRepo{root: root}
+	ctx := Context{Context: context.Background(), MaxParallelSDKs: 2}
+
+	// The languages share the schema, which must only be built once.
+	makefile("build_sdks:\n\ttouch all\n" +
+		"schema:\n\techo built >> schema\n" +
+		"build_nodejs: schema\n\ttouch nodejs\n" +
+		"build_python: schema\n\ttouch python\n" +
+		".PHONY: schema\n")
+	assert.True(t, step.Run(BuildSDKs(ctx, repo)))
+	assert.FileExists(t, filepath.Join(root, "nodejs"))
+	assert.FileExists(t, filepath.Join(root, "python"))
+	assert.NoFileExists(t, filepath.Join(root, "all"))
+	schema, err := os.ReadFile(filepath.Join(root, "schema"))
+	assert.NoError(t, err)
+	assert.Equal(t, "built\n", string(schema))
+
+	// Without per-language targets, every SDK is built with build_sdks.
+	makefile("build_sdks:\n\ttouch all\n")
+	assert.True(t, step.Run(BuildSDKs(ctx, repo)))
+	assert.FileExists(t, filepath.Join(root, "all"))
+}
+
+func TestMakefileTargets(t *testing.T) {
+	root := t.TempDir()
+	// `make -n` would run the recipe lines that use $(MAKE) or start with +.
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "Makefile"), []byte(
+		"VERSION := 1.0\n"+
+			"build_sdks: build_go\n\techo $(MAKE) > sub-make\n"+
+			"build_go:\n\t+touch plus\n"+
+			".PHONY: build_sdks build_go\n"), 0600))
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(root))
+	defer func() { assert.NoError(t, os.Chdir(wd)) }()
+
+	ctx := Context{Context: context.Background()}
+	targets, err := makefileTargets(ctx)
+	assert.NoError(t, err)
+	assert.True(t, targets["build_sdks"])
+	assert.True(t, targets["build_go"])
+	assert.False(t, targets["build_nodejs"])
+	assert.False(t, targets["Makefile"])
+	assert.False(t, targets["VERSION"])
+	assert.NoFileExists(t, filepath.Join(root, "sub-make"))
+	assert.NoFileExists(t, filepath.Join(root, "plus"))
+}
+
+func TestValidateMakeTargets(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "Makefile"),
+		[]byte("tfgen:\n\t$(MAKE) -C sub\n\ttouch ran\n"), 0600))
+
+	ctx := Context{Context: context.Background()}
+	assert.True(t, step.Run(ValidateMakeTargets(ctx, "tfgen").In(&root)))
+	assert.False(t, step.Run(ValidateMakeTargets(ctx, "tfgen", "build_sdks").In(&root)))
+	if assert.NotNil(t, step.LastFailure()) {
+		assert.ErrorContains(t, step.LastFailure().Err, "Makefile has no 'build_sdks' target")
+	}
+	// Validating a target doesn't run it.
+	assert.NoFileExists(t, filepath.Join(root, "ran"))
+}
+
+func TestRecentUpgrade(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	dir := newTestRepo(t)
+	git := func(date string, args ...string) {
+		runGit(t, dir, []string{"GIT_COMMITTER_DATE=" + date, "GIT_AUTHOR_DATE=" + date}, args...)
+	}
+	old := time.Now().Add(-72 * time.Hour).Format(time.RFC3339)
+	now := time.Now().Format(time.RFC3339)
+	git(old, "commit", "--quiet", "--allow-empty", "-m", "Upgrade terraform-provider-aws to v5.0.0 (#10)")
+	git(old, "update-ref", "refs/remotes/origin/upgrade-terraform-provider-aws-to-5.0.0", "HEAD")
+
+	ctx := Context{
+		Context:              context.Background(),
+		UpstreamProviderName: "terraform-provider-aws",
+		SkipIfUpgradedWithin: 24 * time.Hour,
+	}
+	repo := ProviderRepo{root: dir, defaultBranch: "main"}
+	recent := func() string {
+		var found string
+		assert.True(t, step.Run(RecentUpgrade(ctx, &repo, &found)))
+		return found
+	}
+
+	// Upgrades before the window are ignored.
+	assert.Equal(t, "", recent())
+
+	git(now, "commit", "--quiet", "--allow-empty", "-m", "Update the README")
+	git(now, "update-ref", "refs/remotes/origin/fix-docs", "HEAD")
+	assert.Equal(t, "", recent())
+
+	git(now, "update-ref", "refs/remotes/origin/upgrade-pulumi-terraform-bridge-to-v3.80.0", "HEAD")
+	assert.Equal(t, "branch upgrade-pulumi-terraform-bridge-to-v3.80.0", recent())
+
+	git(now, "commit", "--quiet", "--allow-empty", "-m", "Upgrade terraform-provider-aws to v5.1.0 (#12)")
+	assert.Regexp(t, `^commit [0-9a-f]+ Upgrade terraform-provider-aws to v5.1.0 \(#12\)$`, recent())
+}
@@ -0,0 +1,306 @@
+package upgrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+// A Summary describes the outcome of an upgrade.
+type Summary struct {
+	// The provider repository, as {org}/{repo}.
+	Repo string `json:"repo"`
+	// The branch pushed with the upgrade. Empty if no branch was pushed.
+	Branch string `json:"branch,omitempty"`
+	// The kind of the provider repository, once discovered.
+	Kind RepoKind `json:"kind,omitempty"`
+
+	UpstreamFrom string `json:"upstreamFrom,omitempty"`
+	UpstreamTo   string `json:"upstreamTo,omitempty"`
+	BridgeFrom   string `json:"bridgeFrom,omitempty"`
+	BridgeTo     string `json:"bridgeTo,omitempty"`
+
+	// The upstream commit that UpstreamTo resolved to, if known.
+	UpstreamSHA string `json:"upstreamSHA,omitempty"`
+
+	// The outcome of each top level job that was run, in order.
+	Jobs []JobResult `json:"jobs,omitempty"`
+	// The steps that were skipped, in order.
+	Skipped []SkippedStep `json:"skipped,omitempty"`
+
+	// The changes to the schema that break users of the provider.
+	BreakingChanges []string `json:"breakingChanges,omitempty"`
+	// The diff of the go.mod files changed by the upgrade.
+	GoModDiff string `json:"goModDiff,omitempty"`
+}
+
+type JobResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type SkippedStep struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Record the outcome of the top level jobs, and the steps that were skipped, run until the
+// returned function is called.
+func (s *Summary) recordJobs() func() {
+	r := step.CurrentReporter()
+	step.SetReporter(jobRecorder{r, s})
+	return func() { step.SetReporter(r) }
+}
+
+type jobRecorder struct {
+	step.Reporter
+	summary *Summary
+}
+
+func (r jobRecorder) FinishStep(depth int, description string, status step.Status,
+	msg string, dur time.Duration) {
+	if status == step.Skipped {
+		r.summary.Skipped = append(r.summary.Skipped,
+			SkippedStep{description, colorize.Strip(msg)})
+	}
+	r.Reporter.FinishStep(depth, description, status, msg, dur)
+}
+
+func (r jobRecorder) FinishJob(depth int, description string, status step.Status) {
+	if depth == 0 {
+		r.summary.Jobs = append(r.summary.Jobs, JobResult{description, status.String()})
+	}
+	r.Reporter.FinishJob(depth, description, status)
+}
+
+// Display the summary and err, the result of the upgrade, in the given format: "text",
+// "json" or "markdown".
+func (s Summary) Format(format string, err error) string {
+	switch format {
+	case "json":
+		return s.JSON(err)
+	case "markdown":
+		return s.Markdown(err)
+	default:
+		return s.Describe(err)
+	}
+}
+
+// A human readable description of the summary and err, the result of the upgrade.
+func (s Summary) Describe(err error) string {
+	b := new(strings.Builder)
+	if err != nil {
+		fmt.Fprintf(b, "Upgrade of %s failed", s.Repo)
+	} else {
+		fmt.Fprintf(b, "Upgrade of %s succeeded", s.Repo)
+	}
+	if s.UpstreamTo != "" {
+		fmt.Fprintf(b, "\n- upstream: %s", s.upstream())
+	}
+	if s.BridgeTo != "" {
+		fmt.Fprintf(b, "\n- pulumi-terraform-bridge: %s -> %s", s.BridgeFrom, s.BridgeTo)
+	}
+	if s.Branch != "" {
+		fmt.Fprintf(b, "\n- branch: %s", s.branchURL())
+	}
+	if len(s.Skipped) > 0 {
+		b.WriteString("\n- skipped:")
+		for _, skipped := range s.Skipped {
+			fmt.Fprintf(b, "\n  - %s: %s", skipped.Name, skipped.Reason)
+		}
+	}
+	return b.String()
+}
+
+// The summary and err as a JSON object, for tooling.
+func (s Summary) JSON(err error) string {
+	out := struct {
+		Summary
+		Succeeded bool   `json:"succeeded"`
+		Error     string `json:"error,omitempty"`
+	}{Summary: s, Succeeded: err == nil}
+	if err != nil {
+		out.Error = err.Error()
+	}
+	data, mErr := json.MarshalIndent(out, "", "  ")
+	contract.AssertNoErrorf(mErr, "a summary is always valid JSON")
+	return string(data)
+}
+
+// The summary and err as markdown tables, for pasting into PRs and issues.
+func (s Summary) Markdown(err error) string {
+	b := new(strings.Builder)
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	fmt.Fprintf(b, "### Upgrade of %s %s\n\n", s.Repo, result)
+	if err != nil {
+		fmt.Fprintf(b, "```\n%s\n```\n\n", colorize.Strip(err.Error()))
+	}
+
+	b.WriteString("| | |\n|---|---|\n")
+	if s.Kind != "" {
+		fmt.Fprintf(b, "| Kind | %s |\n", s.Kind)
+	}
+	if s.UpstreamTo != "" {
+		fmt.Fprintf(b, "| Upstream | %s |\n", s.upstream())
+	}
+	if s.BridgeTo != "" {
+		fmt.Fprintf(b, "| pulumi-terraform-bridge | %s -> %s |\n", s.BridgeFrom, s.BridgeTo)
+	}
+	if s.Branch != "" {
+		fmt.Fprintf(b, "| Branch | [%s](%s) |\n", s.Branch, s.branchURL())
+	}
+
+	if len(s.Jobs) > 0 {
+		b.WriteString("\n| Step | Status |\n|---|---|\n")
+		for _, job := range s.Jobs {
+			fmt.Fprintf(b, "| %s | %s |\n", job.Name, job.Status)
+		}
+	}
+	if len(s.Skipped) > 0 {
+		b.WriteString("\n| Skipped step | Reason |\n|---|---|\n")
+		for _, skipped := range s.Skipped {
+			fmt.Fprintf(b, "| %s | %s |\n", skipped.Name, skipped.Reason)
+		}
+	}
+	if len(s.BreakingChanges) > 0 {
+		b.WriteString("\n### Breaking changes\n\n")
+		for _, change := range s.BreakingChanges {
+			fmt.Fprintf(b, "- %s\n", change)
+		}
+	}
+	if s.GoModDiff != "" {
+		fmt.Fprintf(b, "\n### go.mod changes\n\n```diff\n%s\n```\n", s.GoModDiff)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (s Summary) upstream() string {
+	from := s.UpstreamFrom
+	if from == "" {
+		from = "unknown"
+	}
+	out := from + " -> " + s.UpstreamTo
+	if s.UpstreamSHA != "" {
+		out += " (" + s.UpstreamSHA + ")"
+	}
+	return out
+}
+
+func (s Summary) branchURL() string {
+	return fmt.Sprintf("https://github.com/%s/tree/%s", s.Repo, s.Branch)
+}
+
+// Post the summary to a Slack incoming webhook.
+//
+// Notification is best-effort: failures are displayed as a warning and otherwise ignored.
+func notifySlack(ctx Context, webhook string, summary Summary, err error) {
+	warn := func(err error) {
+		fmt.Println(colorize.Display(colorize.Warn(fmt.Sprintf("failed to notify slack: %s", err))))
+	}
+	body, mErr := json.Marshal(struct {
+		Text string `json:"text"`
+	}{summary.Describe(err)})
+	if mErr != nil {
+		warn(mErr)
+		return
+	}
+	req, rErr := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if rErr != nil {
+		warn(rErr)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, rErr := http.DefaultClient.Do(req)
+	if rErr != nil {
+		warn(rErr)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		warn(fmt.Errorf("unexpected status %s", resp.Status))
+	}
+}
+
+// The marker that identifies the PR comment made by commentOnPR, so it is updated instead
+// of commented again when the upgrade runs again.
+const summaryCommentMarker = "<!-- upgrade-provider summary -->"
+
+// A comment on a PR, as listed by `gh pr view --json comments`.
+type prComment struct {
+	Body string `json:"body"`
+	URL  string `json:"url"`
+}
+
+var issueCommentID = regexp.MustCompile(`#issuecomment-([0-9]+)$`)
+
+// The ID of the comment made by commentOnPR among comments, if any.
+func findSummaryComment(comments []prComment) (string, bool) {
+	for i := len(comments) - 1; i >= 0; i-- {
+		if !strings.Contains(comments[i].Body, summaryCommentMarker) {
+			continue
+		}
+		if m := issueCommentID.FindStringSubmatch(comments[i].URL); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// Post the markdown summary as a comment on the upgrade PR, updating the comment posted by
+// a previous run if there is one.
+//
+// Commenting is best-effort: failures are displayed as a warning and otherwise ignored.
+func commentOnPR(ctx Context, summary Summary, err error) {
+	warn := func(err error) {
+		fmt.Println(colorize.Display(colorize.Warn(fmt.Sprintf("failed to comment on the PR: %s", err))))
+	}
+	if summary.Branch == "" {
+		return
+	}
+	gh := func(args ...string) ([]byte, error) {
+		out, err := traced(exec.CommandContext(ctx, "gh", args...)).Output()
+		if exit, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("gh %s: %w:\n%s", args[0], err, string(exit.Stderr))
+		}
+		return out, err
+	}
+	out, vErr := gh("pr", "view", summary.Branch, "--repo="+summary.Repo, "--json=number,comments")
+	if vErr != nil {
+		warn(vErr)
+		return
+	}
+	var pr struct {
+		Number   int         `json:"number"`
+		Comments []prComment `json:"comments"`
+	}
+	if uErr := json.Unmarshal(out, &pr); uErr != nil {
+		warn(uErr)
+		return
+	}
+
+	body := summaryCommentMarker + "\n" + summary.Markdown(err)
+	var cErr error
+	if id, ok := findSummaryComment(pr.Comments); ok {
+		_, cErr = gh("api", "--method=PATCH",
+			"repos/"+summary.Repo+"/issues/comments/"+id, "--raw-field=body="+body)
+	} else {
+		_, cErr = gh("pr", "comment", strconv.Itoa(pr.Number), "--repo="+summary.Repo, "--body="+body)
+	}
+	if cErr != nil {
+		warn(cErr)
+	}
+}
@@ -0,0 +1,103 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pulumi/upgrade-provider/colorize"
+	"github.com/pulumi/upgrade-provider/step"
+)
+
+func TestSummaryFormat(t *testing.T) {
+	s := Summary{
+		Repo:         "pulumi/pulumi-random",
+		Branch:       "upgrade-terraform-provider-random-to-v3.5.1",
+		Kind:         Plain,
+		UpstreamFrom: "3.5.0",
+		UpstreamTo:   "3.5.1",
+		Jobs: []JobResult{
+			{"Discovering Repository", "succeeded"},
+			{"Update Artifacts", "failed"},
+		},
+	}
+	err := errors.New("make tfgen failed")
+
+	assert.Equal(t, "### Upgrade of pulumi/pulumi-random failed\n\n"+
+		"```\nmake tfgen failed\n```\n\n"+
+		"| | |\n|---|---|\n"+
+		"| Kind | plain |\n"+
+		"| Upstream | 3.5.0 -> 3.5.1 |\n"+
+		"| Branch | [upgrade-terraform-provider-random-to-v3.5.1]"+
+		"(https://github.com/pulumi/pulumi-random/tree/upgrade-terraform-provider-random-to-v3.5.1) |\n"+
+		"\n| Step | Status |\n|---|---|\n"+
+		"| Discovering Repository | succeeded |\n"+
+		"| Update Artifacts | failed |", s.Format("markdown", err))
+
+	var decoded map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(s.Format("json", err)), &decoded))
+	assert.Equal(t, "pulumi/pulumi-random", decoded["repo"])
+	assert.Equal(t, false, decoded["succeeded"])
+	assert.Equal(t, "make tfgen failed", decoded["error"])
+	assert.Len(t, decoded["jobs"], 2)
+
+	assert.Equal(t, s.Describe(nil), s.Format("text", nil))
+}
+
+func TestSummarySkipped(t *testing.T) {
+	step.SetReporter(step.NewQuietReporter())
+	defer step.SetReporter(step.NewTextReporter())
+
+	s := &Summary{Repo: "pulumi/pulumi-random"}
+	stop := s.recordJobs()
+	step.Run(step.Combined("Discovering Repository",
+		step.F("Planning Provider Update", func() (string, error) {
+			return "", step.Skipf("already at v3.5.1")
+		}),
+		step.F("Planning Bridge Update", func() (string, error) {
+			return "", step.Skipf("%s", colorize.Warn("v3.60.0 does not satisfy <3.60.0"))
+		}),
+		step.F("Planning Plugin SDK Update", func() (string, error) { return "", nil }),
+	))
+	stop()
+
+	assert.Equal(t, []SkippedStep{
+		{"Planning Provider Update", "already at v3.5.1"},
+		{"Planning Bridge Update", "v3.60.0 does not satisfy <3.60.0"},
+	}, s.Skipped)
+	assert.Equal(t, "Upgrade of pulumi/pulumi-random succeeded\n"+
+		"- skipped:\n"+
+		"  - Planning Provider Update: already at v3.5.1\n"+
+		"  - Planning Bridge Update: v3.60.0 does not satisfy <3.60.0", s.Describe(nil))
+}
+
+func TestSummaryMarkdownChanges(t *testing.T) {
+	s := Summary{
+		Repo:            "pulumi/pulumi-random",
+		BreakingChanges: []string{"resource random:index:Legacy was removed"},
+		GoModDiff:       "-\tgithub.com/example/foo v1.0.0\n+\tgithub.com/example/foo v1.1.0",
+	}
+	assert.Equal(t, "### Upgrade of pulumi/pulumi-random succeeded\n\n"+
+		"| | |\n|---|---|\n"+
+		"\n### Breaking changes\n\n"+
+		"- resource random:index:Legacy was removed\n"+
+		"\n### go.mod changes\n\n```diff\n"+
+		"-\tgithub.com/example/foo v1.0.0\n+\tgithub.com/example/foo v1.1.0\n```", s.Markdown(nil))
+}
+
+func TestFindSummaryComment(t *testing.T) {
+	const url = "https://github.com/pulumi/pulumi-random/pull/1#issuecomment-"
+	comments := []prComment{
+		{Body: "LGTM", URL: url + "1"},
+		{Body: summaryCommentMarker + "\n### Upgrade", URL: url + "2"},
+		{Body: "Thanks", URL: url + "3"},
+	}
+	id, ok := findSummaryComment(comments)
+	assert.True(t, ok)
+	assert.Equal(t, "2", id)
+
+	_, ok = findSummaryComment(comments[:1])
+	assert.False(t, ok)
+}
@@ -26,6 +26,36 @@ var CodeMigrations = map[string]CodeMigration{
 }
 
 func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
+	summary := &Summary{Repo: repoOrg + "/" + repoName}
+	err := upgradeProvider(ctx, repoOrg, repoName, summary)
+	publishSummary(ctx, *summary, err)
+	if ctx.ReportFormat != "" && ctx.ReportFormat != "text" {
+		fmt.Println(summary.Format(ctx.ReportFormat, err))
+	} else if ctx.Quiet {
+		fmt.Println(summary.Describe(err))
+	}
+	return err
+}
+
+// Post the summary of an upgrade to Slack and to the upgrade PR, as requested by ctx.
+//
+// --print-steps only shows what would be done, so there is nothing to publish.
+func publishSummary(ctx Context, summary Summary, err error) {
+	if ctx.PrintSteps {
+		return
+	}
+	if ctx.SlackWebhook != "" {
+		notifySlack(ctx, ctx.SlackWebhook, summary, err)
+	}
+	if ctx.SummaryToPRComment {
+		commentOnPR(ctx, summary, err)
+	}
+}
+
+func upgradeProvider(ctx Context, repoOrg, repoName string, summary *Summary) error {
+	// Only the steps skipped while upgrading this provider are left to perform.
+	step.ResetSkipped()
+	defer summary.recordJobs()()
 	var err error
 	repo := ProviderRepo{
 		name: repoName,
@@ -46,13 +76,41 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		step.Env("PULUMI_CONVERT_EXAMPLES_CACHE_DIR", ""),
 	))
 	if !ok {
-		return ErrHandled
+		return handledError()
 	}
 
+	releaseRepo := func() {}
+	defer func() { releaseRepo() }()
+
 	discoverSteps := []step.Step{
+		CheckTokenScopes(ctx),
 		OrgProviderRepos(ctx, repoOrg, repoName).AssignTo(&repo.root),
+		LockRepo(ctx, &repo, &releaseRepo),
 		PullDefaultBranch(ctx, "origin").In(&repo.root).
 			AssignTo(&repo.defaultBranch),
+		step.F("Base Commit", func() (string, error) {
+			return runGitCommand(ctx, func(b []byte) (string, error) {
+				return strings.TrimSpace(string(b)), nil
+			}, "rev-parse", "HEAD")
+		}).In(&repo.root).AssignTo(&repo.baseSHA),
+		CheckSigningKey(ctx).In(&repo.root),
+	}
+
+	if ctx.SkipIfUpgradedWithin > 0 {
+		// We stop as soon as we find a recent upgrade, so the repository is only
+		// discovered as far as finding one needs.
+		var recentUpgrade string
+		ok = step.Run(step.Combined("Checking Recent Upgrades",
+			append(discoverSteps, RecentUpgrade(ctx, &repo, &recentUpgrade))...))
+		if !ok {
+			return handledError()
+		}
+		if recentUpgrade != "" {
+			fmt.Println(colorize.Display(colorize.Bold(fmt.Sprintf(
+				"Skipping: upgraded within %s (%s)", ctx.SkipIfUpgradedWithin, recentUpgrade))))
+			return nil
+		}
+		discoverSteps = nil
 	}
 
 	discoverSteps = append(discoverSteps, step.F("Repo kind", func() (string, error) {
@@ -60,71 +118,225 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		if err != nil {
 			return "", err
 		}
-		return string(goMod.Kind), nil
+		summary.Kind = goMod.Kind
+		msg := string(goMod.Kind)
+		if ctx.AppliedPlan != nil && ctx.AppliedPlan.Kind != goMod.Kind {
+			return "", fmt.Errorf("the plan was made for a %s provider, but the provider is now %s",
+				ctx.AppliedPlan.Kind, goMod.Kind)
+		}
+		if goMod.UpstreamCommit != "" {
+			msg += fmt.Sprintf(" (upstream at commit %s)", goMod.UpstreamCommit)
+		}
+		if goMod.UpstreamIndirect {
+			msg += " " + colorize.Warn("(upstream is only required indirectly, check go.mod)")
+		}
+		if goMod.Vendored {
+			msg += " " + colorize.Warn("(vendored, dependencies will be re-vendored)")
+		}
+		return msg, nil
+	}))
+
+	discoverSteps = append(discoverSteps, step.Computed(func() step.Step {
+		if !goMod.Kind.IsShimmed() {
+			return nil
+		}
+		return CheckShimUpstreamVersion(ctx, repo, goMod)
+	}))
+
+	discoverSteps = append(discoverSteps, step.Computed(func() step.Step {
+		if !goMod.Kind.IsForked() || goMod.Fork == nil {
+			return nil
+		}
+		return CheckForkExists(ctx, goMod)
 	}))
 
+	discoverSteps = append(discoverSteps, step.F("Makefile", func() (string, error) {
+		var err error
+		repo.ciMgmt, err = isCIMgmtMakefile(repo.root)
+		if err != nil {
+			return "", err
+		}
+		if repo.ciMgmt {
+			return "generated by pulumi/ci-mgmt", nil
+		}
+		return "hand written", nil
+	}))
+
+	discoverSteps = append(discoverSteps, step.F("SDK Languages", func() (string, error) {
+		detected, err := detectSDKLanguages(repo.root)
+		if err != nil {
+			return "", err
+		}
+		msg := strings.Join(detected, ", ")
+		if msg == "" {
+			msg = "none found"
+		}
+		if len(ctx.SDKLanguages) == 0 {
+			return msg, nil
+		}
+		generated := map[string]bool{}
+		for _, lang := range detected {
+			generated[lang] = true
+		}
+		for _, lang := range ctx.SDKLanguages {
+			if !generated[lang] {
+				return "", fmt.Errorf("--sdk-languages: the provider does not generate a %s SDK (found %s)",
+					lang, msg)
+			}
+		}
+		return msg + " (building " + strings.Join(ctx.SDKLanguages, ", ") + ")", nil
+	}))
+
+	discoverSteps = append(discoverSteps, step.Computed(func() step.Step {
+		targets := append([]string{"tfgen"}, ctx.sdkBuildTargets()...)
+		if goMod.Kind.IsPatched() {
+			targets = append([]string{"upstream"}, targets...)
+		}
+		return ValidateMakeTargets(ctx, targets...)
+	}).In(&repo.root))
+
 	if ctx.UpgradeProviderVersion {
 		discoverSteps = append(discoverSteps,
 			step.F("Planning Provider Update", func() (string, error) {
 				var msg string
-				upgradeTarget, msg, err = GetExpectedTarget(ctx, repoOrg+"/"+repoName,
-					goMod.UpstreamProviderOrg)
+				upgradeTarget, msg, err = GetExpectedTarget(ctx, repoOrg+"/"+repoName, goMod)
 				if err != nil {
 					return "", err
 				}
 				if upgradeTarget == nil {
 					return "", errors.New("could not determine an upstream version")
 				}
+				if ctx.AppliedPlan != nil {
+					if upgradeTarget.SHA == "" {
+						upgradeTarget.SHA = ctx.AppliedPlan.UpstreamSHA
+					}
+					upgradeTarget.GHIssues = ctx.AppliedPlan.GHIssues
+				}
 
 				// If we have upgrades to perform, we list the new version we will target
 				if upgradeTarget.Version == nil {
 					// Otherwise, we don't bother to try to upgrade the provider.
 					ctx.UpgradeProviderVersion = false
 					ctx.MajorVersionBump = false
-					return "Up to date" + msg, nil
-				}
-				switch {
-				case goMod.Kind.IsPatched():
-					err = setCurrentUpstreamFromPatched(ctx, &repo)
-				case goMod.Kind.IsForked():
-					err = setCurrentUpstreamFromForked(ctx, &repo, goMod)
-				case goMod.Kind.IsShimmed():
-					err = setCurrentUpstreamFromShimmed(ctx, &repo, goMod)
-				case goMod.Kind == Plain:
-					err = setCurrentUpstreamFromPlain(ctx, &repo, goMod)
-				default:
-					return "", fmt.Errorf("Unexpected repo kind: %s", goMod.Kind)
+					return "", step.Skipf("up to date%s", msg)
 				}
+				err = setCurrentUpstream(ctx, &repo, goMod)
 				if err != nil {
 					return "", fmt.Errorf("current upstream version: %w", err)
 				}
 
 				var previous string
-				if repo.currentUpstreamVersion != nil {
-					if goSemver.Compare("v"+repo.currentUpstreamVersion.String(),
-						"v"+upgradeTarget.Version.String()) != -1 {
-						return "", fmt.Errorf("current upstream version %v is greater than/ equal to the target version %v",
+				if upgradeTarget.Branch != "" {
+					// Only go modules can pin a branch tip: other kinds of
+					// providers check out or merge the version's tag.
+					if goMod.Kind != Plain && goMod.Kind != Shimmed {
+						return "", fmt.Errorf("cannot target a branch tip for %s providers", goMod.Kind)
+					}
+					// A branch tip moves between releases, so we compare commits
+					// instead of versions.
+					if goMod.UpstreamCommit != "" &&
+						strings.HasPrefix(upgradeTarget.SHA, goMod.UpstreamCommit) && !ctx.Force {
+						ctx.UpgradeProviderVersion = false
+						ctx.MajorVersionBump = false
+						return "", step.Skipf("already at the tip of %s", upgradeTarget.Branch)
+					}
+				} else if repo.currentUpstreamVersion != nil {
+					cmp := goSemver.Compare("v"+repo.currentUpstreamVersion.String(),
+						"v"+upgradeTarget.Version.String())
+					// A pinned commit past the tag of the current version is still
+					// an upgrade, unless the provider already pins the commit.
+					pinned := upgradeTarget.SHA != "" && !(goMod.UpstreamCommit != "" &&
+						strings.HasPrefix(upgradeTarget.SHA, goMod.UpstreamCommit))
+					if cmp == 0 && !pinned && !ctx.Force {
+						// The provider already pins the target version, so there
+						// is nothing to upgrade.
+						ctx.UpgradeProviderVersion = false
+						ctx.MajorVersionBump = false
+						return "", step.Skipf("already at v%s", upgradeTarget.Version)
+					}
+					if cmp == 1 {
+						return "", fmt.Errorf("current upstream version %v is greater than the target version %v",
 							repo.currentUpstreamVersion, upgradeTarget.Version)
 					}
+					// Major versions usually need human attention, so we don't
+					// jump over several of them unless asked to.
+					jump := upgradeTarget.Version.Major() - repo.currentUpstreamVersion.Major()
+					if ctx.MaxMajorJump > 0 && jump > uint64(ctx.MaxMajorJump) {
+						return "", fmt.Errorf("upgrading from %v to %v jumps %d major versions, "+
+							"more than --max-major-jump=%d allows",
+							repo.currentUpstreamVersion, upgradeTarget.Version, jump, ctx.MaxMajorJump)
+					}
 					previous = fmt.Sprintf("%s -> ", repo.currentUpstreamVersion)
 				}
 
 				return previous + upgradeTarget.Version.String() + msg, nil
+			}),
+			step.Computed(func() step.Step {
+				if !ctx.UpgradeProviderVersion || goMod.Kind.IsForked() ||
+					upgradeTarget.SHA != "" {
+					return nil
+				}
+				// We have an upstream we don't control, so we need to get it's SHA. We
+				// do this instead of using version tags because we can't ensure that the
+				// upstream is versioning their go modules correctly.
+				//
+				// It they are versioning correctly, `go mod tidy` will resolve the SHA to
+				// a tag.
+				//
+				// We look up the SHA during discovery so a missing tag fails the upgrade
+				// before we make any changes.
+				return step.F("Lookup Tag SHA", func() (string, error) {
+					sha, err := lookupTagSHA(ctx, upstreamRepoPath(ctx, goMod.Upstream.Path),
+						upgradeTarget.Version)
+					if err != nil {
+						return "", err
+					}
+					upgradeTarget.SHA = sha
+					return ctx.upstreamTag(upgradeTarget.Version) + " -> " + sha, nil
+				})
 			}))
 	}
 
 	if ctx.UpgradeBridgeVersion {
 		discoverSteps = append(discoverSteps,
 			step.F("Planning Bridge Update", func() (string, error) {
-				latest, err := latestRelease(ctx, "pulumi/pulumi-terraform-bridge")
+				var latest *semver.Version
+				switch {
+				case ctx.AppliedPlan != nil:
+					latest, err = semver.NewVersion(ctx.AppliedPlan.BridgeTo)
+				case ctx.BridgeVersionConstraint != nil:
+					// The latest release might not satisfy the constraint, so we look
+					// for the highest release that does.
+					var tags []string
+					tags, err = releaseTags(ctx, "pulumi/pulumi-terraform-bridge")
+					if err != nil {
+						return "", err
+					}
+					latest = highestMatching(tags, semver.NewVersion, ctx.BridgeVersionConstraint)
+					if latest == nil {
+						ctx.UpgradeBridgeVersion = false
+						return "", step.Skipf("%s", colorize.Warn(fmt.Sprintf(
+							"no release satisfies --bridge-version-constraint=%s",
+							ctx.BridgeVersionConstraint)))
+					}
+				default:
+					latest, err = latestRelease(ctx, "pulumi/pulumi-terraform-bridge")
+				}
 				if err != nil {
 					return "", err
 				}
 
+				if ctx.BridgeVersionConstraint != nil && !ctx.BridgeVersionConstraint.Check(latest) {
+					ctx.UpgradeBridgeVersion = false
+					return "", step.Skipf("%s", colorize.Warn(fmt.Sprintf(
+						"%s does not satisfy --bridge-version-constraint=%s",
+						latest.Original(), ctx.BridgeVersionConstraint)))
+				}
+
 				// If our target upgrade version is the same as our current version, we skip the update.
 				if latest.Original() == goMod.Bridge.Version {
 					ctx.UpgradeBridgeVersion = false
-					return fmt.Sprintf("Up to date at %s", latest.Original()), nil
+					return "", step.Skipf("up to date at %s", latest.Original())
 				}
 
 				targetBridgeVersion = latest.Original()
@@ -202,7 +414,7 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 
 	ok = step.Run(step.Combined("Discovering Repository", discoverSteps...))
 	if !ok {
-		return ErrHandled
+		return handledError()
 	}
 
 	if ctx.UpgradeProviderVersion {
@@ -216,11 +428,29 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		}
 	}
 
+	if ctx.UpgradeProviderVersion {
+		summary.UpstreamTo = upgradeTarget.Version.String()
+		summary.UpstreamSHA = upgradeTarget.SHA
+		if repo.currentUpstreamVersion != nil {
+			summary.UpstreamFrom = repo.currentUpstreamVersion.String()
+		}
+	}
+	if ctx.UpgradeBridgeVersion {
+		summary.BridgeFrom = goMod.Bridge.Version
+		summary.BridgeTo = targetBridgeVersion
+	}
+
 	// Running the discover steps might have invalidated one or more actions. If there
 	// are no actions remaining, we can exit early.
 	if !ctx.UpgradeBridgeVersion && !ctx.UpgradeProviderVersion &&
 		!ctx.UpgradeCodeMigration && !ctx.UpgradeSdkVersion {
-		fmt.Println(colorize.Bold("No actions needed"))
+		fmt.Println(colorize.Display(colorize.Bold("No actions needed")))
+		// Plans don't change anything, so they don't delete branches either.
+		if ctx.DeleteRemoteBranchOnNoop && !ctx.PrintSteps && ctx.PlanFile == "" {
+			if !step.Run(DeleteStaleBranches(ctx, repo, goMod)) {
+				return handledError()
+			}
+		}
 		return nil
 	}
 
@@ -231,44 +461,100 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		}
 		ctx.MigrationOpts = keys
 	} else if !ctx.UpgradeCodeMigration && len(ctx.MigrationOpts) > 0 {
-		fmt.Println(colorize.Warn("--migration-opts passed but --kind does not indicate a code migration"))
+		fmt.Println(colorize.Display(colorize.Warn(
+			"--migration-opts passed but --kind does not indicate a code migration")))
+	}
+
+	// When only planning, we record the steps instead of running them.
+	planning := ctx.PrintSteps || ctx.PlanFile != ""
+
+	// The target version is the decision most likely to be silently wrong, so we let
+	// the user check it before we change anything.
+	if ctx.ConfirmVersion && ctx.UpgradeProviderVersion && !ctx.Yes && !planning {
+		confirmed, err := confirm(colorize.Display(fmt.Sprintf("Upgrade %s to %s (%s)?",
+			ctx.UpstreamProviderName, colorize.Bold(ctx.upstreamTag(upgradeTarget.Version)),
+			ctx.targetSource(goMod))))
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return fmt.Errorf("target version %s was not confirmed", upgradeTarget.Version)
+		}
+	}
+	plan := Plan{
+		Repo:         repoOrg + "/" + repoName,
+		Kind:         goMod.Kind,
+		UpstreamFrom: summary.UpstreamFrom,
+		UpstreamTo:   summary.UpstreamTo,
+		BridgeFrom:   summary.BridgeFrom,
+		BridgeTo:     summary.BridgeTo,
+	}
+	if upgradeTarget != nil {
+		plan.UpstreamSHA = upgradeTarget.SHA
+		plan.GHIssues = upgradeTarget.GHIssues
+	}
+
+	if ctx.ContinueMerge && !(goMod.Kind.IsForked() && ctx.UpgradeProviderVersion) {
+		return errors.New("--continue only applies to upgrading forked providers")
 	}
 
 	var forkedProviderUpstreamCommit string
 	if goMod.Kind.IsForked() && ctx.UpgradeProviderVersion {
-		ok = step.Run(upgradeUpstreamFork(ctx, repo.name, upgradeTarget.Version, goMod).
-			AssignTo(&forkedProviderUpstreamCommit))
-		if !ok {
-			return ErrHandled
+		upgradeFork, release := upgradeUpstreamFork(ctx, repo.name, upgradeTarget.Version, upgradeTarget.SHA, goMod)
+		defer release()
+		if planning {
+			plan.addSteps(upgradeFork)
+			// The fork commit is only known after the fork is upgraded.
+			forkedProviderUpstreamCommit = "<fork commit>"
+		} else {
+			ok = step.Run(upgradeFork.AssignTo(&forkedProviderUpstreamCommit))
+			if !ok {
+				return handledError()
+			}
 		}
 	}
 
 	var targetSHA string
+	if upgradeTarget != nil {
+		targetSHA = upgradeTarget.SHA
+	}
+	// The major version of the provider after the upgrade, for --branch-template.
+	var major int64
+	if ctx.BranchTemplate != "" {
+		if ctx.MajorVersionBump {
+			major = int64(repo.currentVersion.Major()) + 1
+		} else if major, err = providerMajor(repo); err != nil {
+			return fmt.Errorf("--branch-template: %w", err)
+		}
+	}
 	if ctx.UpgradeProviderVersion {
-		repo.workingBranch = fmt.Sprintf("upgrade-%s-to-v%s",
-			ctx.UpstreamProviderName, upgradeTarget.Version)
+		repo.workingBranch = providerUpgradeBranch(ctx, upgradeTarget.Version, major)
 	} else if ctx.UpgradeBridgeVersion {
 		contract.Assertf(targetBridgeVersion != "",
 			"We are upgrading the bridge, so we must have a target version")
-		repo.workingBranch = fmt.Sprintf("upgrade-pulumi-terraform-bridge-to-%s",
-			targetBridgeVersion)
+		repo.workingBranch = bridgeUpgradeBranch(ctx, targetBridgeVersion, major)
 	} else if ctx.UpgradeCodeMigration {
 		repo.workingBranch = "upgrade-code-migration"
 	} else {
 		return fmt.Errorf("calculating branch name: unknown action")
 	}
+	// A failed upgrade may still have pushed the branch, or opened its PR in a previous run.
+	summary.Branch = repo.workingBranch
 	steps := []step.Step{
-		EnsureBranchCheckedOut(ctx, repo.workingBranch).In(&repo.root),
+		EnsureBranchCheckedOut(ctx, repo.workingBranch, repo.defaultBranch).In(&repo.root),
 	}
 
 	if ctx.MajorVersionBump {
 		steps = append(steps, MajorVersionBump(ctx, goMod, upgradeTarget, repo))
 
 		defer func() {
-			fmt.Printf("\n\n" + colorize.Warn("Major Version Updates are not fully automated!") + "\n")
+			if planning {
+				return
+			}
+			fmt.Printf("\n\n%s\n", colorize.Display(colorize.Warn("Major Version Updates are not fully automated!")))
 			fmt.Printf("Steps 1..9, 12 and 13 have been automated. Step 11 can be skipped.\n")
 			fmt.Printf("%s need to complete Step 10: Updating README.md and sdk/python/README.md "+
-				"in a follow up commit.\n", colorize.Bold("You"))
+				"in a follow up commit.\n", colorize.Display(colorize.Bold("You")))
 			fmt.Printf("Steps are listed at\n\t" +
 				"https://github.com/pulumi/platform-providers-team/blob/main/playbooks/tf-provider-major-version-update.md\n")
 		}()
@@ -282,28 +568,38 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		// `upstream` in a usable state. Otherwise, we need to call `make
 		// upstream` to ensure that the module is valid (for `go get` and `go mod
 		// tidy`.
-		steps = append(steps, step.Cmd(exec.CommandContext(ctx, "make", "upstream")).In(&repo.root))
+		steps = append(steps, step.Cmd(makeCmd(ctx, "upstream")).In(&repo.root))
 	}
 
 	if ctx.UpgradeBridgeVersion {
-		steps = append(steps, step.Cmd(exec.CommandContext(ctx,
-			"go", "get", "github.com/pulumi/pulumi-terraform-bridge/v3@"+targetBridgeVersion)).
+		steps = append(steps, step.Cmd(goCmd(ctx,
+			"get", "github.com/pulumi/pulumi-terraform-bridge/v3@"+targetBridgeVersion)).
 			In(repo.providerDir()))
 	}
-	if ctx.UpgradeSdkVersion {
+	// A bridge upgrade pins the SDK to the version the compat matrix lists for the
+	// bridge, or upgrades the SDK with `go get -u` if the bridge is not listed.
+	var pinnedSDK string
+	if ctx.UpgradeBridgeVersion {
+		pinnedSDK, _ = ctx.CompatMatrix.SDKVersion(targetBridgeVersion)
+	}
+	const sdkModule, pkgModule = "github.com/pulumi/pulumi/sdk/v3", "github.com/pulumi/pulumi/pkg/v3"
+	var getSDK []string
+	switch {
+	case pinnedSDK != "":
+		getSDK = []string{"get", sdkModule + "@" + pinnedSDK, pkgModule + "@" + pinnedSDK}
+	case ctx.UpgradeSdkVersion:
+		getSDK = []string{"get", sdkModule, pkgModule}
+	case ctx.UpgradeBridgeVersion:
+		getSDK = []string{"get", "-u", sdkModule, pkgModule}
+	}
+	if getSDK != nil {
+		// The examples are kept on the same SDK as the provider.
 		steps = append(steps, step.Combined("Upgrade Pulumi SDK",
-			step.Cmd(exec.CommandContext(ctx,
-				"go", "get", "github.com/pulumi/pulumi/sdk/v3")).
-				In(repo.providerDir()),
-			step.Cmd(exec.CommandContext(ctx,
-				"go", "get", "github.com/pulumi/pulumi/pkg/v3")).
-				In(repo.providerDir())),
-			step.Cmd(exec.CommandContext(ctx,
-				"go", "get", "github.com/pulumi/pulumi/sdk/v3")).
-				In(repo.examplesDir()),
-			step.Cmd(exec.CommandContext(ctx,
-				"go", "get", "github.com/pulumi/pulumi/pkg/v3")).
-				In(repo.examplesDir()))
+			step.Cmd(goCmd(ctx, getSDK...)).In(repo.providerDir()),
+			step.Cmd(goCmd(ctx, getSDK...)).In(repo.examplesDir())))
+		if pinnedSDK != "" {
+			steps = append(steps, CheckPinnedSDK(ctx, repo, targetBridgeVersion, pinnedSDK))
+		}
 	}
 
 	if ctx.UpgradeCodeMigration {
@@ -313,7 +609,7 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		})
 		for _, opt := range ctx.MigrationOpts {
 			if _, ok := applied[opt]; ok {
-				fmt.Println(colorize.Warn("Duplicate code migration " + colorize.Bold(opt)))
+				fmt.Println(colorize.Display(colorize.Warn("Duplicate code migration " + colorize.Bold(opt))))
 				continue
 			}
 			applied[opt] = struct{}{}
@@ -333,19 +629,103 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 		}
 	}
 
-	addPluginStep := step.Cmd(exec.CommandContext(ctx, "pulumi", "plugin", "rm", "--all", "--yes"))
-	if !ctx.RemovePlugins {
+	var addPluginStep step.Step
+	if ctx.RemovePlugins {
+		// This removes every plugin installed on the machine, not just the
+		// plugins used by this provider.
+		addPluginStep = step.Combined("Remove all installed Pulumi plugins (global)",
+			step.Cmd(exec.CommandContext(ctx, "pulumi", "plugin", "rm", "--all", "--yes")))
+	} else if !ctx.KeepPlugins {
 		addPluginStep = step.Cmd(exec.Command("echo", "Plugins not removed."))
 	}
 
+	var verifyBuild step.Step
+	if ctx.VerifyBuild {
+		// Catch compile errors against the new upstream before we run tfgen.
+		verifyBuild = step.Combined("Verify Provider Build",
+			ProviderGoCmd(ctx, repo, "build", "./..."),
+			ProviderGoCmd(ctx, repo, "vet", "./..."),
+		)
+	}
+
+	// In squash mode, changes are staged as we go and committed once at the end.
+	squash := ctx.CommitMode == "squash"
+	commit := func(msg, body string) step.Step {
+		if squash {
+			return nil
+		}
+		return GitCommit(ctx, msg, body).In(&repo.root)
+	}
+
+	var commitDependencies, commitSquashed step.Step
+	if ctx.CommitMode == "per-step" {
+		commitDependencies = step.Combined("Commit Dependencies",
+			step.Cmd(exec.CommandContext(ctx, "git", "add", "--all")),
+			GitCommit(ctx, ctx.commitMessage("go mod tidy", "deps", "update dependencies"), ""),
+		).In(&repo.root)
+	}
+
+	var regenerateExamples step.Step
+	if ctx.RegenerateExamples {
+		regenerateExamples = step.Combined("Regenerate Examples",
+			RegenerateExamples(ctx, repo),
+			step.Cmd(exec.CommandContext(ctx, "git", "add", "--all")).In(&repo.root),
+			commit(ctx.commitMessage("make "+ctx.ExamplesTarget, "examples", "regenerate examples"), ""),
+		)
+	}
+
+	var verifyPlugin step.Step
+	if ctx.VerifyPlugin {
+		verifyPlugin = VerifyPlugin(ctx, repo)
+	}
+
+	var gofmt step.Step
+	if ctx.Gofmt || ctx.Goimports {
+		// tfgen output is not always gofmt clean, which CI rejects, so we format it
+		// before it is committed.
+		formatter := "gofmt"
+		if ctx.Goimports {
+			formatter = "goimports"
+		}
+		gofmt = step.Cmd(exec.CommandContext(ctx, formatter, "-w", ".")).In(repo.providerDir())
+	}
+
+	var vendor step.Step
+	if goMod.Vendored {
+		vendor = step.Cmd(goCmd(ctx, "mod", "vendor")).In(repo.providerDir())
+	}
+
+	commitMsgBody := commitBody(ctx, repo, upgradeTarget, goMod, targetBridgeVersion)
+	if squash {
+		title := upgradeTitle(ctx, upgradeTarget, targetBridgeVersion)
+		commitSquashed = GitCommit(ctx, ctx.commitMessage(title, "deps", lowerFirst(title)),
+			commitMsgBody).In(&repo.root)
+	}
+
+	expectedBridge := goMod.Bridge.Version
+	if ctx.UpgradeBridgeVersion {
+		expectedBridge = targetBridgeVersion
+	}
+
+	// The breaking changes to the schema, if ctx.CheckBreakingChanges is set.
+	var breakingChanges []string
+
 	artifacts := append(steps,
-		step.Cmd(exec.CommandContext(ctx, "go", "mod", "tidy")).In(repo.providerDir()),
-		step.Cmd(exec.CommandContext(ctx, "go", "mod", "tidy")).In(repo.examplesDir()),
+		ProviderGoCmd(ctx, repo, "mod", "tidy"),
+		CheckBridgeVersion(ctx, repo, expectedBridge),
+		vendor,
+		step.Cmd(goCmd(ctx, "mod", "tidy")).In(repo.examplesDir()),
+		commitDependencies,
+		verifyBuild,
 		addPluginStep,
-		step.Cmd(exec.CommandContext(ctx, "make", "tfgen")).In(&repo.root),
+		MakeTarget(ctx, repo, "tfgen"),
+		CheckTfgenOutput(ctx, repo),
+		CheckBreakingChanges(ctx, repo, &breakingChanges),
+		gofmt,
 		step.Cmd(exec.CommandContext(ctx, "git", "add", "--all")).In(&repo.root),
-		GitCommit(ctx, "make tfgen").In(&repo.root),
-		step.Cmd(exec.CommandContext(ctx, "make", "build_sdks")).In(&repo.root),
+		commit(ctx.commitMessage("make tfgen", "deps", lowerFirst(
+			upgradeTitle(ctx, upgradeTarget, targetBridgeVersion))), commitMsgBody),
+		BuildSDKs(ctx, repo),
 		step.Computed(func() step.Step {
 			if !ctx.MajorVersionBump {
 				return nil
@@ -366,18 +746,38 @@ func UpgradeProvider(ctx Context, repoOrg, repoName string) error {
 				return nil
 			}
 			dir := filepath.Join(repo.root, "sdk")
-			return step.Cmd(exec.CommandContext(ctx, "go", "mod", "tidy")).
+			return step.Cmd(goCmd(ctx, "mod", "tidy")).
 				In(&dir)
 		}),
 		step.Cmd(exec.CommandContext(ctx, "git", "add", "--all")).In(&repo.root),
-		GitCommit(ctx, "make build_sdks").In(&repo.root),
-		InformGitHub(ctx, upgradeTarget, repo, goMod, targetBridgeVersion, tfSDKUpgrade),
+		commit(ctx.commitMessage("make build_sdks", "sdk", "regenerate SDKs"), commitMsgBody),
+		regenerateExamples,
+		verifyPlugin,
+		PostStepHooks(ctx, repo),
+		commitSquashed,
+		InformGitHub(ctx, upgradeTarget, repo, goMod, targetBridgeVersion, tfSDKUpgrade,
+			&breakingChanges),
 	)
 
+	if planning {
+		plan.Branch = repo.workingBranch
+		plan.addSteps(step.Combined("Update Artifacts", artifacts...))
+		if ctx.PrintSteps {
+			plan.printSteps()
+		}
+		if ctx.PlanFile != "" {
+			return plan.write(ctx.PlanFile)
+		}
+		return nil
+	}
+
 	ok = step.Run(step.Combined("Update Artifacts", artifacts...))
 	if !ok {
-		return ErrHandled
+		return handledError()
 	}
 
+	summary.BreakingChanges = breakingChanges
+	// The diff is only informative, so we don't fail without it.
+	summary.GoModDiff, _ = goModDiff(ctx, repo, goMod)
 	return nil
 }
@@ -2,11 +2,21 @@ package upgrade
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+
+	"github.com/pulumi/upgrade-provider/step"
 )
 
 type Context struct {
@@ -16,37 +26,435 @@ type Context struct {
 	GoPath string
 	// An optional path to clone the provider repo to
 	repoPath string
+	// The URL to clone the provider repo from, overriding https://github.com/{org}/{repo}.
+	ProviderRepoURL string
+	// If positive, the depth of git clones.
+	CloneDepth int
+	// Clone the upstream fork into a temporary directory instead of sharing a checkout.
+	Isolated bool
+	// Don't lock the provider repo against concurrent runs.
+	NoLock bool
+	// Discard an unfinished merge or uncommitted changes in the upstream checkout of a
+	// forked provider, instead of failing.
+	ResetUpstream bool
 
 	TargetVersion *semver.Version
 	InferVersion  bool
+	// If set, only versions that satisfy the constraint are targeted.
+	VersionConstraint *semver.Constraints
+	// If set, the bridge version must satisfy the constraint.
+	BridgeVersionConstraint *semver.Constraints
+	// Require target and discovered versions to be fully specified semver.
+	StrictSemver bool
+	// The number of issues to request at once when inferring the version from issues.
+	IssueLimit int
+	// Consider upgrade issues filed by any author, not just pulumi-bot.
+	AnyAuthor bool
+	// The state of the upgrade issues to consider: "open", "closed" or "all". Open issues
+	// are considered if empty.
+	IssueState string
+	// A path to a local checkout of the upstream provider. If set, the upgrade targets
+	// the checked out commit.
+	TargetFromUpstreamCheckout string
+	// An upstream branch. If set, the upgrade targets the commit at the tip of the branch.
+	TargetBranchTip string
+	// Target the latest release of the upstream repo, as reported by GitHub.
+	TargetLatestUpstreamRelease bool
+	// A branch whose name ends in the target version, such as "deps/upstream-v5.2.0".
+	TargetFromBranch string
+	// Ask the user to confirm the target version after discovery.
+	ConfirmVersion bool
+	// Answer yes to any prompt, such as the one asked by ConfirmVersion.
+	Yes bool
 
 	UpgradeBridgeVersion bool
 	UpgradeSdkVersion    bool
+	// The pulumi SDK versions to pin when the bridge is upgraded.
+	CompatMatrix CompatMatrix
 
 	UpgradeProviderVersion bool
 	MajorVersionBump       bool
+	// Run the provider upgrade even if the provider already pins the target version.
+	Force bool
+	// The largest number of upstream major versions an upgrade may jump. 0 means no limit.
+	MaxMajorJump int
 
 	UpstreamProviderName string
+	// The {owner}/{repo} of the upstream provider on GitHub. If set, it is used to clone the
+	// upstream, to name the pulumi fork and to look up upstream tags and releases, instead
+	// of the repo derived from the upstream module path.
+	UpstreamOwnerRepo string
+	// The org of providers that are named without an {org}, such as "pulumiverse".
+	PulumiOrg string
+	// Additional upstream providers bridged by a composite provider, mapping the name of
+	// the upstream provider to the version to upgrade it to.
+	AdditionalUpstreams map[string]*semver.Version
+	// The GOPROXY used to resolve modules in `go get` and `go mod tidy`. If empty, the
+	// inherited environment is used.
+	GoProxy string
+	// The GOFLAGS of go and make commands. If empty, the inherited environment is used.
+	GoFlags string
+	// The GOPRIVATE and GONOSUMDB of go and make commands, so that private modules are
+	// not verified against the checksum database. If empty, the inherited environment is
+	// used.
+	GoPrivate string
+	GoNoSumDB string
+	// Repair go.sum when a tidy or build of the provider fails with missing go.sum
+	// entries, then retry once.
+	RepairGoSum bool
+	// Raise the go directive of the provider when a tidy or build of the provider fails
+	// because a dependency requires a newer go, then retry once.
+	BumpGoDirective bool
+	// The prefix of upstream release tags, such as "v" in "v1.2.3".
+	TagPrefix string
 
 	UpgradeCodeMigration bool
 	MigrationOpts        []string
 
+	// The SDK languages to build. If empty, all SDKs are built with `make build_sdks`.
+	SDKLanguages []string
+	// The number of jobs of a single `make -j` that builds each SDK language with
+	// `make build_{language}`. At most one builds the SDKs in sequence.
+	MaxParallelSDKs int
+
 	AllowMissingDocs   bool
+	VerifyBuild        bool
+	VerifyPlugin       bool
 	RemovePlugins      bool
+	KeepPlugins        bool
 	PrReviewers        string
+	PrLabels           []string
+	PrMilestone        string
+	PrAssignee         string
+	Draft              bool
 	CreateFailureIssue bool
+	// Compare the regenerated schema against the default branch, and label upgrades
+	// with breaking changes.
+	CheckBreakingChanges bool
+	// Wait for the required checks of the upgrade PR to complete, for at most
+	// ChecksTimeout.
+	WaitForChecks bool
+	ChecksTimeout time.Duration
+	// The style of commit messages: "plain" or "conventional".
+	CommitStyle string
+	// The type and scope of conventional commit messages. An empty scope uses a
+	// default scope for each commit.
+	CommitType  string
+	CommitScope string
+	// The committer of the commits of the upgrade, if not git's default.
+	GitCommitterName  string
+	GitCommitterEmail string
+	// Delete the remote branches of previous upgrades when there is nothing to upgrade.
+	DeleteRemoteBranchOnNoop bool
+	// Skip the provider if it was upgraded within this duration, by an upgrade commit on
+	// the default branch or an upgrade branch. Zero never skips.
+	SkipIfUpgradedWithin time.Duration
+	// The name of the working branch, with the placeholders {name}, {version}, {major}
+	// and {date}. If empty, branches are named upgrade-{name}-to-{version}.
+	BranchTemplate string
+	// Sign the commits of the upgrade, with SigningKey if set.
+	SignCommits bool
+	SigningKey  string
+	// How the changes of the upgrade are grouped into commits: "two", "squash" or
+	// "per-step".
+	CommitMode string
+
+	// User supplied shell commands run after the upgrade and before pushing. Failures
+	// of PostStepHooks fail the upgrade, failures of OptionalPostStepHooks do not.
+	PostStepHooks         []string
+	OptionalPostStepHooks []string
+
+	// The fork commit to replace the upstream with, overriding the head of the upgraded
+	// upstream branch. Only used by forked providers.
+	ForkUpstreamCommit string
+	// The URL of the pulumi fork, overriding the URL computed from the provider name. Only
+	// used by forked providers.
+	ForkRemoteURL string
+	// Bump the replaces in the fork's go.mod that point to other pulumi maintained forks.
+	// Only used by forked providers.
+	BumpTransitiveForks bool
+	// Continue the upgrade of a forked provider after the conflicts of the upstream
+	// merge were resolved and committed by hand.
+	ContinueMerge bool
+
+	// The format of the summary displayed after the upgrade: "text", "json" or "markdown".
+	ReportFormat string
+
+	// Display the steps of the upgrade after discovery, instead of running them.
+	PrintSteps bool
+	// Write the Plan of the upgrade to this file after discovery, instead of running it.
+	PlanFile string
+	// A Plan to apply. Its versions are used instead of discovering them.
+	AppliedPlan *Plan
+
+	// Run gofmt on the provider after tfgen, committing any changes with the tfgen output.
+	Gofmt bool
+	// Like Gofmt, but run goimports instead of gofmt.
+	Goimports bool
+	// Run `make ExamplesTarget` after the SDKs are built, committing any changes.
+	RegenerateExamples bool
+	ExamplesTarget     string
+
+	// Only display failures, warnings and a final summary.
+	Quiet bool
+
+	// Fail on inconsistencies that would otherwise be warnings.
+	Strict bool
+
+	// Abort instead of warning when the remote default branch has moved since the
+	// upgrade branch was created.
+	RequireFreshBase bool
+	// An optional Slack incoming webhook URL, notified when the upgrade completes.
+	SlackWebhook string
+	// Post the markdown summary as a comment on the upgrade PR.
+	SummaryToPRComment bool
 }
 
 func (c *Context) SetRepoPath(p string) {
 	c.repoPath = p
 }
 
-type HandledError struct{}
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The commit message for a commit. plain is used unless ctx.CommitStyle is
+// "conventional", in which case the message is "type(scope): subject".
+func (c Context) commitMessage(plain, scope, subject string) string {
+	if c.CommitStyle != "conventional" {
+		return plain
+	}
+	if c.CommitScope != "" {
+		scope = c.CommitScope
+	}
+	if scope != "" {
+		scope = "(" + scope + ")"
+	}
+	return c.CommitType + scope + ": " + subject
+}
+
+// The assignee of the upgrade PR and the issues it closes, "@me" unless set.
+func (c Context) prAssignee() string {
+	if c.PrAssignee == "" {
+		return "@me"
+	}
+	return c.PrAssignee
+}
+
+// If failed go commands of the provider are repaired and retried.
+func (c Context) repairsGoModules() bool {
+	return c.RepairGoSum || c.BumpGoDirective
+}
+
+// Record cmd in the --trace transcript, for commands that are run outside of step.Cmd.
+func traced(cmd *exec.Cmd) *exec.Cmd {
+	step.Trace(cmd)
+	return cmd
+}
+
+// A `go` command, such as `go get` or `go mod tidy`.
+//
+// If ctx.GoProxy is set, it is used as the GOPROXY of the command. The environment set by
+// ctx.GoFlags, ctx.GoPrivate and ctx.GoNoSumDB is described by goEnv.
+func goCmd(ctx Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Env = goEnv(ctx)
+	if ctx.GoProxy != "" {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, "GOPROXY="+ctx.GoProxy)
+	}
+	return cmd
+}
+
+// A `git commit args...` command.
+//
+// If ctx.GitCommitterName is set, it is used with ctx.GitCommitterEmail as the committer
+// of the commit. The author is left to git. If ctx.SignCommits is set, the commit is
+// signed with ctx.SigningKey, or git's default signing key.
+func gitCommitCmd(ctx Context, args ...string) *exec.Cmd {
+	commit := []string{"commit"}
+	if ctx.SigningKey != "" {
+		commit = append(commit, "--gpg-sign="+ctx.SigningKey)
+	} else if ctx.SignCommits {
+		commit = append(commit, "-S")
+	}
+	cmd := exec.CommandContext(ctx, "git", append(commit, args...)...)
+	if ctx.GitCommitterName != "" {
+		cmd.Env = append(os.Environ(),
+			"GIT_COMMITTER_NAME="+ctx.GitCommitterName,
+			"GIT_COMMITTER_EMAIL="+ctx.GitCommitterEmail)
+	}
+	return cmd
+}
+
+// A `make` command, such as `make tfgen`.
+//
+// The environment set by ctx.GoFlags, ctx.GoPrivate and ctx.GoNoSumDB is described by
+// goEnv.
+func makeCmd(ctx Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "make", args...)
+	cmd.Env = goEnv(ctx)
+	return cmd
+}
+
+// The environment of commands that build go code, or nil to inherit the environment.
+//
+// ctx.GoFlags, ctx.GoPrivate and ctx.GoNoSumDB are used as the GOFLAGS, GOPRIVATE and
+// GONOSUMDB of the command when set. They are only set for go commands, not for the
+// process.
+func goEnv(ctx Context) []string {
+	var env []string
+	for _, kv := range []struct{ key, value string }{
+		{"GOFLAGS", ctx.GoFlags},
+		{"GOPRIVATE", ctx.GoPrivate},
+		{"GONOSUMDB", ctx.GoNoSumDB},
+	} {
+		if kv.value != "" {
+			env = append(env, kv.key+"="+kv.value)
+		}
+	}
+	if env == nil {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+// The make targets that build the SDKs.
+func (c Context) sdkBuildTargets() []string {
+	if len(c.SDKLanguages) == 0 {
+		return []string{"build_sdks"}
+	}
+	targets := make([]string, len(c.SDKLanguages))
+	for i, lang := range c.SDKLanguages {
+		targets[i] = "build_" + lang
+	}
+	return targets
+}
+
+// A description of where the target version comes from.
+func (c Context) targetSource(goMod *GoMod) string {
+	switch {
+	case c.AppliedPlan != nil:
+		return "from the applied plan"
+	case c.InferVersion:
+		return "from upgrade issues"
+	case c.TargetFromUpstreamCheckout != "":
+		return "from the checkout at " + c.TargetFromUpstreamCheckout
+	case c.TargetBranchTip != "":
+		return "from the tip of branch " + c.TargetBranchTip
+	case c.TargetLatestUpstreamRelease:
+		return "from the latest GitHub release of the upstream"
+	case c.TargetFromBranch != "":
+		return "from the name of branch " + c.TargetFromBranch
+	case c.TargetVersion != nil:
+		return "from --target-version"
+	case goMod != nil && goMod.TargetDirective != "":
+		return "from the upgrade-target comment in go.mod"
+	default:
+		return "from the latest upstream release"
+	}
+}
+
+// The upstream tag that corresponds to version v.
+//
+// Build metadata is not part of the tag, so v2.0.0+incompatible is tagged as v2.0.0.
+func (c Context) upstreamTag(v *semver.Version) string {
+	return c.TagPrefix + withoutMetadata(v).String()
+}
+
+// Upstreams at major version 2 or above that don't have a go.mod are required with this
+// suffix.
+const incompatibleSuffix = "+incompatible"
+
+// withoutMetadata returns v without its build metadata, such as the +incompatible suffix.
+func withoutMetadata(v *semver.Version) *semver.Version {
+	if v.Metadata() == "" {
+		return v
+	}
+	stripped, err := v.SetMetadata("")
+	contract.AssertNoErrorf(err, "removing metadata cannot fail")
+	return &stripped
+}
+
+// The go.mod version to require for upstream at target.
+//
+// An upstream that is currently required as +incompatible keeps the suffix, unless
+// target is no longer at a major version that needs it.
+func upstreamModVersion(upstream module.Version, target *semver.Version) string {
+	v := "v" + withoutMetadata(target).String()
+	if strings.HasSuffix(upstream.Version, incompatibleSuffix) &&
+		versionSuffix.FindStringIndex(upstream.Path) == nil && target.Major() >= 2 {
+		v += incompatibleSuffix
+	}
+	return v
+}
+
+// Parse an upstream tag into a version, stripping the tag prefix.
+func (c Context) parseUpstreamTag(tag string) (*semver.Version, error) {
+	return c.ParseVersion(strings.TrimPrefix(tag, c.TagPrefix))
+}
+
+// Parse a version, with an optional "v" prefix.
+//
+// Versions are parsed leniently, so "1.2" is parsed as 1.2.0. If c.StrictSemver is set,
+// versions must be fully specified as MAJOR.MINOR.PATCH instead.
+func (c Context) ParseVersion(v string) (*semver.Version, error) {
+	if !c.StrictSemver {
+		return semver.NewVersion(v)
+	}
+	parsed, err := semver.StrictNewVersion(strings.TrimPrefix(v, "v"))
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a MAJOR.MINOR.PATCH version (--strict-semver): %w", v, err)
+	}
+	return parsed, nil
+}
+
+// An error that has already been displayed to the user.
+//
+// If the error was caused by a failed step, the step is described by the fields of the
+// error. All HandledErrors match ErrHandled with errors.Is.
+type HandledError struct {
+	// The name of the step that failed.
+	Step string
+	// The error the step failed with.
+	Err error
+	// The standard output of the failed step, if it ran a command.
+	Output string
+}
 
 var ErrHandled = HandledError{}
 
-func (HandledError) Error() string {
-	return "Program failed and displayed the error to the user"
+// A HandledError describing why the last step.Run failed.
+func handledError() error {
+	failure := step.LastFailure()
+	if failure == nil {
+		return ErrHandled
+	}
+	return HandledError{Step: failure.Step, Err: failure.Err, Output: failure.Output}
+}
+
+func (err HandledError) Error() string {
+	if err.Err == nil {
+		return "Program failed and displayed the error to the user"
+	}
+	if err.Step == "" {
+		return err.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", err.Step, err.Err)
+}
+
+func (err HandledError) Unwrap() error { return err.Err }
+
+func (HandledError) Is(target error) bool {
+	_, ok := target.(HandledError)
+	return ok
 }
 
 type ProviderRepo struct {
@@ -56,6 +464,10 @@ type ProviderRepo struct {
 	defaultBranch string
 	// The working branch of the repository
 	workingBranch string
+	// The commit of the default branch that the working branch is based on
+	baseSHA string
+	// If the Makefile of the repository is generated by pulumi/ci-mgmt
+	ciMgmt bool
 
 	// The highest version tag released on the repo
 	currentVersion *semver.Version
@@ -81,15 +493,83 @@ func (p ProviderRepo) examplesDir() *string {
 type GoMod struct {
 	Kind     RepoKind
 	Upstream module.Version
-	Fork     *modfile.Replace
-	Bridge   module.Version
+	// The requires of each of ctx.AdditionalUpstreams, sorted by name.
+	AdditionalUpstreams []module.Version
+	Fork                *modfile.Replace
+	Bridge              module.Version
 
 	UpstreamProviderOrg string
+	// The upstream commit referenced by the upstream require when it is a pseudo-version,
+	// such as "abcdef123456" in "v0.0.0-20230101000000-abcdef123456". Otherwise empty.
+	UpstreamCommit string
+	// The path of the upstream submodule, if Kind is Submodule.
+	Submodule string
+	// If the provider vendors its dependencies in provider/vendor.
+	Vendored bool
+	// If the upstream require is marked `// indirect`.
+	UpstreamIndirect bool
+	// The target version from an `// upgrade-target:` comment on the upstream require,
+	// if any.
+	TargetDirective string
+}
+
+// The JSON representation of a GoMod. module.Version and modfile.Replace don't have
+// stable JSON representations of their own.
+type goModJSON struct {
+	Kind                RepoKind     `json:"kind"`
+	Upstream            moduleJSON   `json:"upstream"`
+	AdditionalUpstreams []moduleJSON `json:"additionalUpstreams,omitempty"`
+	Fork                *forkJSON    `json:"fork,omitempty"`
+	Bridge              moduleJSON   `json:"bridge"`
+	UpstreamProviderOrg string       `json:"upstreamProviderOrg,omitempty"`
+	UpstreamCommit      string       `json:"upstreamCommit,omitempty"`
+	Submodule           string       `json:"submodule,omitempty"`
+	Vendored            bool         `json:"vendored"`
+	UpstreamIndirect    bool         `json:"upstreamIndirect"`
+	TargetDirective     string       `json:"targetDirective,omitempty"`
+}
+
+type moduleJSON struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+type forkJSON struct {
+	Old moduleJSON `json:"old"`
+	New moduleJSON `json:"new"`
+}
+
+func (g GoMod) MarshalJSON() ([]byte, error) {
+	toJSON := func(m module.Version) moduleJSON {
+		return moduleJSON{Path: m.Path, Version: m.Version}
+	}
+	out := goModJSON{
+		Kind:                g.Kind,
+		Upstream:            toJSON(g.Upstream),
+		Bridge:              toJSON(g.Bridge),
+		UpstreamProviderOrg: g.UpstreamProviderOrg,
+		UpstreamCommit:      g.UpstreamCommit,
+		Submodule:           g.Submodule,
+		Vendored:            g.Vendored,
+		UpstreamIndirect:    g.UpstreamIndirect,
+		TargetDirective:     g.TargetDirective,
+	}
+	for _, m := range g.AdditionalUpstreams {
+		out.AdditionalUpstreams = append(out.AdditionalUpstreams, toJSON(m))
+	}
+	if g.Fork != nil {
+		out.Fork = &forkJSON{Old: toJSON(g.Fork.Old), New: toJSON(g.Fork.New)}
+	}
+	return json.Marshal(out)
 }
 
 type UpstreamUpgradeTarget struct {
 	// The version we are targeting. `nil` indicates that no upstream upgrade was found.
 	Version *semver.Version
+	// The upstream commit to pin. If empty, the commit of the version's tag is used.
+	SHA string
+	// The upstream branch that SHA is the tip of, if we target a branch instead of a tag.
+	Branch string
 	// The list of issues that this upgrade will close.
 	GHIssues []UpgradeTargetIssue
 }
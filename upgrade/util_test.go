@@ -0,0 +1,157 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		strict  bool
+		err     bool
+	}{
+		{"1.2.3", false, false},
+		{"v1.2.3", false, false},
+		{"1.2", false, false},
+		{"1.2.3", true, false},
+		{"v1.2.3", true, false},
+		{"1.2", true, true},
+		{"v1", true, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.version, func(t *testing.T) {
+			_, err := Context{StrictSemver: tt.strict}.ParseVersion(tt.version)
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUpstreamModVersion(t *testing.T) {
+	tests := []struct {
+		upstream module.Version
+		target   string
+		expected string
+	}{
+		{module.Version{Path: "github.com/a/b", Version: "v1.2.0"}, "1.3.0", "v1.3.0"},
+		{module.Version{Path: "github.com/a/b", Version: "v2.0.0+incompatible"}, "2.1.0", "v2.1.0+incompatible"},
+		{module.Version{Path: "github.com/a/b", Version: "v2.0.0+incompatible"}, "2.1.0+incompatible", "v2.1.0+incompatible"},
+		{module.Version{Path: "github.com/a/b/v2", Version: "v2.0.0"}, "2.1.0", "v2.1.0"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.upstream.Version+"->"+tt.target, func(t *testing.T) {
+			assert.Equal(t, tt.expected, upstreamModVersion(tt.upstream, semver.MustParse(tt.target)))
+		})
+	}
+
+	// Tags never carry the suffix.
+	ctx := Context{TagPrefix: "v"}
+	assert.Equal(t, "v2.1.0", ctx.upstreamTag(semver.MustParse("2.1.0+incompatible")))
+}
+
+func TestGoCmdEnv(t *testing.T) {
+	ctx := Context{Context: context.Background()}
+	assert.Nil(t, goCmd(ctx, "build").Env)
+	assert.Nil(t, makeCmd(ctx, "tfgen").Env)
+
+	ctx.GoFlags = "-mod=mod"
+	ctx.GoProxy = "direct"
+	assert.Subset(t, goCmd(ctx, "build").Env, []string{"GOFLAGS=-mod=mod", "GOPROXY=direct"})
+	assert.Contains(t, makeCmd(ctx, "tfgen").Env, "GOFLAGS=-mod=mod")
+	assert.NotContains(t, makeCmd(ctx, "tfgen").Env, "GOPROXY=direct")
+
+	ctx.GoPrivate = "github.com/my-org/*"
+	ctx.GoNoSumDB = "github.com/my-fork/*"
+	private := []string{"GOPRIVATE=github.com/my-org/*", "GONOSUMDB=github.com/my-fork/*"}
+	assert.Subset(t, goCmd(ctx, "get").Env, private)
+	assert.Subset(t, makeCmd(ctx, "tfgen").Env, private)
+}
+
+func TestGitCommitCmd(t *testing.T) {
+	ctx := Context{Context: context.Background()}
+	cmd := gitCommitCmd(ctx, "-m", "msg")
+	assert.Equal(t, []string{"git", "commit", "-m", "msg"}, cmd.Args)
+	assert.Nil(t, cmd.Env)
+
+	ctx.GitCommitterName = "CI Bot"
+	ctx.GitCommitterEmail = "ci@example.com"
+	assert.Subset(t, gitCommitCmd(ctx, "-m", "msg").Env,
+		[]string{"GIT_COMMITTER_NAME=CI Bot", "GIT_COMMITTER_EMAIL=ci@example.com"})
+}
+
+func TestGitCommitCmdSigned(t *testing.T) {
+	ctx := Context{Context: context.Background(), SignCommits: true}
+	assert.Equal(t, []string{"git", "commit", "-S", "-m", "msg"}, gitCommitCmd(ctx, "-m", "msg").Args)
+
+	ctx.SigningKey = "ABCD1234"
+	assert.Equal(t, []string{"git", "commit", "--gpg-sign=ABCD1234", "-m", "msg"},
+		gitCommitCmd(ctx, "-m", "msg").Args)
+}
+
+func TestGoModJSON(t *testing.T) {
+	goMod := GoMod{
+		Kind:     Forked,
+		Upstream: module.Version{Path: "github.com/hashicorp/terraform-provider-aws", Version: "v1.0.0"},
+		Fork: &modfile.Replace{
+			Old: module.Version{Path: "github.com/hashicorp/terraform-provider-aws"},
+			New: module.Version{Path: "github.com/pulumi/terraform-provider-aws", Version: "v0.0.0-1"},
+		},
+		Bridge:              module.Version{Path: "github.com/pulumi/pulumi-terraform-bridge/v3", Version: "v3.50.0"},
+		UpstreamProviderOrg: "hashicorp",
+	}
+	data, err := json.Marshal(&goMod)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+  "kind": "forked",
+  "upstream": {"path": "github.com/hashicorp/terraform-provider-aws", "version": "v1.0.0"},
+  "fork": {
+    "old": {"path": "github.com/hashicorp/terraform-provider-aws"},
+    "new": {"path": "github.com/pulumi/terraform-provider-aws", "version": "v0.0.0-1"}
+  },
+  "bridge": {"path": "github.com/pulumi/pulumi-terraform-bridge/v3", "version": "v3.50.0"},
+  "upstreamProviderOrg": "hashicorp",
+  "vendored": false,
+  "upstreamIndirect": false
+}`, string(data))
+}
+
+func TestCompatMatrix(t *testing.T) {
+	matrix, err := parseCompatMatrix("matrix.yaml", []byte(`
+v3.60: v3.78.0
+3.60.2: 3.78.1
+`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		bridge, expected string
+	}{
+		{"v3.60.0", "v3.78.0"},
+		{"v3.60.2", "v3.78.1"},
+		{"v3.61.0", ""},
+	}
+	for _, tt := range tests {
+		sdk, ok := matrix.SDKVersion(tt.bridge)
+		assert.Equal(t, tt.expected != "", ok, tt.bridge)
+		assert.Equal(t, tt.expected, sdk, tt.bridge)
+	}
+
+	_, err = parseCompatMatrix("matrix.yaml", []byte("v3.60.0: latest\n"))
+	assert.ErrorContains(t, err, "matrix.yaml: v3.60.0")
+
+	// The built in matrix is valid, and pins known bridge versions.
+	builtin, err := ReadCompatMatrix("")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, builtin)
+}